@@ -0,0 +1,164 @@
+package nexns
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 访问 Controller 的认证方式
+const (
+	AuthHeader = "header" // 在请求头中发送 client_id 与 client_secret
+	AuthBearer = "bearer" // OAuth2 client credentials 获取的 Bearer Token
+	AuthHMAC   = "hmac"   // 以 client_secret 对请求做 HMAC 签名，secret 不在网络上传输
+)
+
+// Authenticator adds credentials to a request to the controller, HTTP or WebSocket upgrade
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// authenticator returns the configured Authenticator, static headers by default
+func (c *Controller) authenticator() Authenticator {
+	if c.auth == nil {
+		return &headerAuth{controller: c}
+	}
+	return c.auth
+}
+
+// checkUnauthorized drops a cached token the controller rejected, it may have been revoked
+func (c *Controller) checkUnauthorized(response *http.Response) {
+	if response.StatusCode != http.StatusUnauthorized {
+		return
+	}
+	if invalidator, ok := c.authenticator().(interface{ Invalidate() }); ok {
+		invalidator.Invalidate()
+	}
+}
+
+// headerAuth sends the client id and secret as headers
+type headerAuth struct {
+	controller *Controller
+}
+
+func (a *headerAuth) Authenticate(req *http.Request) error {
+	req.Header.Set("X-CLIENT-ID", a.controller.ClientId)
+	req.Header.Set("X-CLIENT-SECRET", a.controller.clientSecret())
+	return nil
+}
+
+// hmacAuth signs "METHOD\nPATH?QUERY\nTIMESTAMP\nNONCE" with HMAC-SHA256 keyed by the client secret,
+// the controller rejects stale timestamps and reused nonces
+type hmacAuth struct {
+	controller *Controller
+}
+
+func (a *hmacAuth) Authenticate(req *http.Request) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generate nonce error: %v", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+
+	mac := hmac.New(sha256.New, []byte(a.controller.clientSecret()))
+	mac.Write([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + timestamp + "\n" + nonceHex))
+
+	req.Header.Set("X-CLIENT-ID", a.controller.ClientId)
+	req.Header.Set("X-TIMESTAMP", timestamp)
+	req.Header.Set("X-NONCE", nonceHex)
+	req.Header.Set("X-SIGNATURE", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// bearerAuth gets OAuth2 access tokens with the client credentials grant and refreshes them before expiry
+type bearerAuth struct {
+	controller *Controller
+	tokenURL   string
+	scopes     []string
+
+	mu      sync.Mutex
+	token   string
+	refresh time.Time // 在此之后获取新 token，早于过期时间
+}
+
+// TokenRefreshMargin 是 token 过期前提前刷新的时间，不超过 token 有效期的四分之一
+const TokenRefreshMargin = 30 * time.Second
+
+// tokenResponse is the OAuth2 token endpoint response
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func (a *bearerAuth) Authenticate(req *http.Request) error {
+	token, err := a.getToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Invalidate drops the cached token, after the controller rejected it
+func (a *bearerAuth) Invalidate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.token = ""
+}
+
+func (a *bearerAuth) getToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Now().Before(a.refresh) {
+		return a.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(a.scopes) > 0 {
+		form.Set("scope", strings.Join(a.scopes, " "))
+	}
+	req, err := http.NewRequest("POST", a.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", requestError("POST", a.tokenURL, "%v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.controller.ClientId), url.QueryEscape(a.controller.clientSecret()))
+
+	response, err := a.controller.httpClient().Do(req)
+	if err != nil {
+		return "", requestError("POST", a.tokenURL, "request failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	token := tokenResponse{}
+	if err := a.controller.readJSON(a.tokenURL, response, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" || (token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer")) {
+		return "", requestError("POST", a.tokenURL, "no bearer token in response")
+	}
+
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	if token.ExpiresIn <= 0 {
+		lifetime = time.Hour
+	}
+
+	// refresh a little early, so a token never expires in flight, but short lived tokens are still reused
+	a.token = token.AccessToken
+	a.refresh = time.Now().Add(lifetime - min(TokenRefreshMargin, lifetime/4))
+	log.Debug("Got new access token.")
+
+	return a.token, nil
+}
@@ -0,0 +1,115 @@
+package nexns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHMACAuth(t *testing.T) {
+	c := &Controller{ClientId: "id", ClientSecret: "secret"}
+	c.auth = &hmacAuth{controller: c}
+
+	req, err := c.newRequestWithCredentials("http://controller/api/v1/domain/dump/?x=1")
+	if err != nil {
+		t.Fatalf("Error creating request: %s", err)
+	}
+	if req.Header.Get("X-CLIENT-SECRET") != "" {
+		t.Fatalf("Secret must not be sent with hmac auth")
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("GET\n/api/v1/domain/dump/?x=1\n" + req.Header.Get("X-TIMESTAMP") + "\n" + req.Header.Get("X-NONCE")))
+	if req.Header.Get("X-SIGNATURE") != hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("Signature mismatch")
+	}
+
+	// nonce is fresh for every request
+	next, _ := c.newRequestWithCredentials("http://controller/api/v1/domain/dump/?x=1")
+	if next.Header.Get("X-NONCE") == req.Header.Get("X-NONCE") {
+		t.Fatalf("Expected a new nonce per request")
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	issued := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "id" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "dns" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		issued++
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":3600}`, issued)
+	}))
+	defer server.Close()
+
+	c := &Controller{ClientId: "id", ClientSecret: "secret"}
+	c.auth = &bearerAuth{controller: c, tokenURL: server.URL, scopes: []string{"dns"}}
+
+	for i := 0; i < 2; i++ {
+		req, err := c.newRequestWithCredentials("http://controller/")
+		if err != nil {
+			t.Fatalf("Error creating request: %s", err)
+		}
+		if req.Header.Get("Authorization") != "Bearer token-1" {
+			t.Fatalf("Expected cached token-1, got %q", req.Header.Get("Authorization"))
+		}
+	}
+
+	// rejected token is replaced
+	c.checkUnauthorized(&http.Response{StatusCode: http.StatusUnauthorized})
+	req, err := c.newRequestWithCredentials("http://controller/")
+	if err != nil {
+		t.Fatalf("Error creating request: %s", err)
+	}
+	if req.Header.Get("Authorization") != "Bearer token-2" {
+		t.Fatalf("Expected new token-2, got %q", req.Header.Get("Authorization"))
+	}
+}
+
+func TestBearerAuthShortLivedToken(t *testing.T) {
+	issued := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issued++
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":20}`, issued)
+	}))
+	defer server.Close()
+
+	c := &Controller{ClientId: "id", ClientSecret: "secret"}
+	c.auth = &bearerAuth{controller: c, tokenURL: server.URL}
+
+	// a token living shorter than the refresh margin is still reused
+	for i := 0; i < 3; i++ {
+		req, err := c.newRequestWithCredentials("http://controller/")
+		if err != nil {
+			t.Fatalf("Error creating request: %s", err)
+		}
+		if req.Header.Get("Authorization") != "Bearer token-1" {
+			t.Fatalf("Expected cached token-1, got %q", req.Header.Get("Authorization"))
+		}
+	}
+	if issued != 1 {
+		t.Fatalf("Expected 1 token issued, got %d", issued)
+	}
+}
+
+func TestBearerAuthError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := &Controller{ClientId: "id", ClientSecret: "secret"}
+	c.auth = &bearerAuth{controller: c, tokenURL: server.URL}
+
+	_, err := c.newRequestWithCredentials("http://controller/")
+	if err == nil || !strings.Contains(err.Error(), "POST "+server.URL+": unexpected status 500") {
+		t.Fatalf("Expected error of the token POST, got %v", err)
+	}
+}
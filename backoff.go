@@ -0,0 +1,38 @@
+package nexns
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially growing retry delays with jitter
+type backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	attempt int
+}
+
+// Next returns the delay before the next retry
+func (b *backoff) Next() time.Duration {
+	ceiling := b.Max
+	if b.attempt < 32 {
+		if d := b.Min << uint(b.attempt); d > 0 && d < b.Max {
+			ceiling = d
+		}
+	}
+	b.attempt++
+
+	// random in [ceiling/2, ceiling), so retries of many nodes spread out but never hammer
+	half := ceiling / 2
+	return half + time.Duration(rand.Int63n(int64(ceiling-half)+1))
+}
+
+// Reset starts over from Min, after a success
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
+
+// Exhaust jumps to Max, after a failure retrying soon can't fix
+func (b *backoff) Exhaust() {
+	b.attempt = 32
+}
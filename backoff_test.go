@@ -0,0 +1,27 @@
+package nexns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := backoff{Min: time.Second, Max: time.Minute}
+
+	for i, ceiling := range []time.Duration{1, 2, 4, 8, 16, 32, 60, 60} {
+		ceiling *= time.Second
+		if d := b.Next(); d < ceiling/2 || d > ceiling {
+			t.Fatalf("Attempt %d: delay %s not in [%s, %s]", i, d, ceiling/2, ceiling)
+		}
+	}
+
+	b.Reset()
+	if d := b.Next(); d > time.Second {
+		t.Fatalf("Expected delay to start over after reset, got %s", d)
+	}
+
+	b.Exhaust()
+	if d := b.Next(); d < 30*time.Second {
+		t.Fatalf("Expected max delay after exhaust, got %s", d)
+	}
+}
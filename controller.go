@@ -0,0 +1,84 @@
+package nexns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Controller 是一个 NexNS Controller 及其同步状态，同一 syncEngine 中多个 Controller 的域名合并到同一个 Trie 中
+type Controller struct {
+	Name       string
+	URLs       []string // 按优先级排列，第一个为首选
+	Precedence int      // 多个 Controller 发布同一域名时，数值大的优先，相同时先声明的优先
+
+	ClientId     string
+	ClientSecret string
+	TLSConfig    *tls.Config
+	TLSPins      []string
+	ProxyURL     string
+
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	MaxBodySize    int64
+
+	ReconcileInterval time.Duration
+	SyncMode          string
+	PollInterval      time.Duration
+	NotifyTransport   string // push 模式下接收变更通知的传输方式
+	NotifyAddress     string // grpc 服务地址，缺省与 Controller 地址相同
+
+	tlsArgs []string   // arguments of the tls option, TLSConfig can't be compared
+	source  DataSource // the NexNS Controller at URLs unless another source was set
+
+	engine  *syncEngine
+	domains map[string]*DomainData // domains published by this controller, guarded by engine.updateLock
+
+	ready       atomic.Bool
+	validators  pollValidators
+	notifyState connectionState
+	secretFile  *secretFile
+	auth        Authenticator
+	endpoints   *controllerEndpoints
+	client      *http.Client
+	dialer      *websocket.Dialer
+}
+
+func newController(e *syncEngine) *Controller {
+	c := &Controller{
+		ReconcileInterval: DefaultReconcileInterval,
+		SyncMode:          SyncPush,
+		NotifyTransport:   NotifyWebSocket,
+		engine:            e,
+		domains:           make(map[string]*DomainData),
+	}
+	c.source = &remoteSource{controller: c}
+	return c
+}
+
+// name returns the name of the controller in logs, metrics and snapshots
+func (c *Controller) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.source.String()
+}
+
+// start syncs the controller in background until stop is closed
+func (c *Controller) start(stop <-chan struct{}) {
+	go c.runDataSource(stop)
+}
+
+// key describes the settings of the controller, controllers with equal keys sync the same data
+func (c *Controller) key() string {
+	return fmt.Sprintf("source %#v name %q precedence %d", c.source, c.Name, c.Precedence)
+}
+
+// Ready reports whether data of the controller was loaded or restored from snapshot
+func (c *Controller) Ready() bool {
+	return c.ready.Load()
+}
@@ -0,0 +1,89 @@
+package nexns
+
+import (
+	"testing"
+)
+
+// buildTestingController adds a controller publishing all domains of the database to the engine
+func buildTestingController(e *syncEngine, urls ...string) *Controller {
+	controller := newController(e)
+	controller.URLs = urls
+	e.Controllers = append(e.Controllers, controller)
+	controller.applyAllData(e.dumpDatabase())
+	return controller
+}
+
+func TestDumpMergeConcurrentUpdate(t *testing.T) {
+	e := newSyncEngine("")
+	first := newController(e)
+	first.Name = "first"
+	second := newController(e)
+	second.Name = "second"
+	e.Controllers = []*Controller{first, second}
+	first.applyAllData([]DomainData{{Domain: Domain{ID: 1, Name: "old.com", Serial: "1"}}})
+
+	merge := first.newDumpMerge()
+	merge.add(&DomainData{Domain: Domain{ID: 2, Name: "example.com", Serial: "1"}})
+	if e.Database().Search("example.com.") != nil {
+		t.Fatalf("Expected dump not to be served before it's finished")
+	}
+
+	// another controller changes the database while the dump is decoded
+	second.applyAllData([]DomainData{{Domain: Domain{ID: 3, Name: "test.com", Serial: "1"}}})
+	merge.finish()
+
+	if e.Database().Search("example.com.") == nil || e.Database().Search("test.com.") == nil {
+		t.Fatalf("Expected domains of both controllers to be served")
+	}
+	if e.Database().Search("old.com.") != nil {
+		t.Fatalf("Expected domain missing from the dump to be removed")
+	}
+}
+
+func TestMergeControllers(t *testing.T) {
+	e := newSyncEngine("")
+
+	low := newController(e)
+	low.Name = "low"
+	high := newController(e)
+	high.Name = "high"
+	high.Precedence = 10
+	e.Controllers = []*Controller{low, high}
+
+	low.applyAllData([]DomainData{
+		{Domain: Domain{ID: 1, Name: "example.com", Serial: "1"}},
+		{Domain: Domain{ID: 2, Name: "low.com", Serial: "1"}},
+	})
+	high.applyAllData([]DomainData{
+		{Domain: Domain{ID: 7, Name: "example.com", Serial: "2"}},
+	})
+
+	if domainData := e.Database().Search("example.com."); domainData == nil || domainData.Source != "high" || domainData.Domain.ID != 7 {
+		t.Fatalf("Expected example.com from controller with higher precedence, got %+v", domainData)
+	}
+	if domainData := e.Database().Search("low.com."); domainData == nil || domainData.Source != "low" {
+		t.Fatalf("Expected low.com from its only controller")
+	}
+
+	// low updates are shadowed while high publishes the domain
+	low.applyDomainData(&DomainData{Domain: Domain{ID: 1, Name: "example.com", Serial: "3"}})
+	if domainData := e.Database().Search("example.com."); domainData.Source != "high" {
+		t.Fatalf("Expected example.com to stay with controller high")
+	}
+
+	// high drops the domain, low takes over
+	high.applyAllData([]DomainData{})
+	if domainData := e.Database().Search("example.com."); domainData == nil || domainData.Source != "low" || domainData.Domain.Serial != "3" {
+		t.Fatalf("Expected example.com from controller low, got %+v", domainData)
+	}
+
+	// one controller's full load leaves the other's domains alone
+	low.applyAllData([]DomainData{{Domain: Domain{ID: 1, Name: "example.com", Serial: "3"}}})
+	if e.Database().Search("low.com.") != nil {
+		t.Fatalf("Expected low.com to be removed")
+	}
+	high.applyAllData([]DomainData{{Domain: Domain{ID: 8, Name: "high.com", Serial: "1"}}})
+	if e.Database().Search("example.com.") == nil || e.Database().Search("high.com.") == nil {
+		t.Fatalf("Expected domains of both controllers to be served")
+	}
+}
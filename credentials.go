@@ -0,0 +1,68 @@
+package nexns
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretFile holds a secret read from a file, re-read whenever the file changes,
+// so credentials can be rotated without restarting CoreDNS
+type secretFile struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+func newSecretFile(path string) *secretFile {
+	return &secretFile{path: path}
+}
+
+// get returns the current secret, re-reading the file if it changed since last read
+func (s *secretFile) get() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return s.value, fmt.Errorf("stat secret file error: %v", err)
+	}
+	if s.value != "" && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.value, nil
+	}
+
+	content, err := os.ReadFile(s.path)
+	if err != nil {
+		return s.value, fmt.Errorf("read secret file error: %v", err)
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return s.value, fmt.Errorf("secret file %s is empty", s.path)
+	}
+
+	if s.value != "" && value != s.value {
+		log.Infof("Client secret reloaded from %s", s.path)
+	}
+	s.value = value
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+
+	return s.value, nil
+}
+
+// clientSecret returns the secret to authenticate to the controller with
+func (c *Controller) clientSecret() string {
+	if c.secretFile == nil {
+		return c.ClientSecret
+	}
+
+	secret, err := c.secretFile.get()
+	if err != nil {
+		log.Warningf("Failed to load client secret, using last known: %v", err)
+	}
+	return secret
+}
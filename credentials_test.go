@@ -0,0 +1,33 @@
+package nexns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecretFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("secret-1\n"), 0600); err != nil {
+		t.Fatalf("Error writing secret file: %s", err)
+	}
+
+	c := &Controller{secretFile: newSecretFile(path)}
+	if secret := c.clientSecret(); secret != "secret-1" {
+		t.Fatalf("Expected secret-1, got %q", secret)
+	}
+
+	// rotate
+	os.WriteFile(path, []byte("secret-2\n"), 0600)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if secret := c.clientSecret(); secret != "secret-2" {
+		t.Fatalf("Expected rotated secret-2, got %q", secret)
+	}
+
+	// file gone, keep last known secret
+	os.Remove(path)
+	if secret := c.clientSecret(); secret != "secret-2" {
+		t.Fatalf("Expected last known secret-2, got %q", secret)
+	}
+}
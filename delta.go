@@ -0,0 +1,199 @@
+package nexns
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// RRset 变更类型
+const (
+	DeltaUpsert = "upsert" // 新增或整体替换 RRset
+	DeltaDelete = "delete" // 删除 RRset，只需给出 RRset ID
+)
+
+// DomainDelta 包含了域名从序列号 FromSerial 变更到 Serial 的 RRset 级变更
+type DomainDelta struct {
+	Domain     int           `json:"domain"`
+	FromSerial string        `json:"from_serial"`
+	Serial     string        `json:"serial"`
+	Changes    []RRSetChange `json:"changes"`
+}
+
+// RRSetChange 描述了某个视图（zone）下一个 RRset 的变更
+type RRSetChange struct {
+	Zone   int    `json:"zone"`
+	Action string `json:"action"`
+	RRSet  RRSet  `json:"rrset"`
+}
+
+// errDeltaGap means deltas can't be applied to the local data, the domain must be refetched
+var errDeltaGap = errors.New("delta sequence gap")
+
+// domainByID returns the local data of a domain by its id, with updateLock held
+func (c *Controller) domainByID(id int) *DomainData {
+	for _, domainData := range c.domains {
+		if domainData.Domain.ID == id {
+			return domainData
+		}
+	}
+	return nil
+}
+
+// applyDeltas applies consecutive deltas of one domain to a copy of its local data and merges it.
+// Returns errDeltaGap if the deltas don't continue from the local serial.
+func (c *Controller) applyDeltas(id int, deltas []DomainDelta) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+
+	c.engine.updateLock.Lock()
+	current := c.domainByID(id)
+	if current == nil {
+		c.engine.updateLock.Unlock()
+		return fmt.Errorf("%w: domain id %d not loaded", errDeltaGap, id)
+	}
+
+	// data in the database is shared and never modified, changes go to a copy
+	domainData := copyDomainData(current)
+	for _, delta := range deltas {
+		if delta.Domain != id || delta.FromSerial != domainData.Domain.Serial {
+			c.engine.updateLock.Unlock()
+			return fmt.Errorf("%w: domain id %d at serial %s, delta from %s", errDeltaGap, id, domainData.Domain.Serial, delta.FromSerial)
+		}
+		err := domainData.applyDelta(delta)
+		if err != nil {
+			c.engine.updateLock.Unlock()
+			return err
+		}
+	}
+
+	c.domains[domainData.Domain.Name] = domainData
+	c.engine.mergeDomains([]string{domainData.Domain.Name})
+	c.engine.updateLock.Unlock()
+	c.engine.updateSnapshot()
+
+	return nil
+}
+
+// copyDomainData copies a domain down to its RRset lists, which are the parts deltas replace
+func copyDomainData(domainData *DomainData) *DomainData {
+	copied := *domainData
+	copied.Zones = make([]Zone, len(domainData.Zones))
+	for i, zone := range domainData.Zones {
+		copied.Zones[i] = zone
+		copied.Zones[i].RRsets = append([]RRSet(nil), zone.RRsets...)
+	}
+	return &copied
+}
+
+// applyDelta applies the changes of a delta to the domain, which must be a copy
+func (d *DomainData) applyDelta(delta DomainDelta) error {
+	for _, change := range delta.Changes {
+		zone := d.zoneByID(change.Zone)
+		if zone == nil {
+			return fmt.Errorf("%w: zone id %d of domain %s not loaded", errDeltaGap, change.Zone, d.Domain.Name)
+		}
+
+		index := -1
+		for i, rrset := range zone.RRsets {
+			if rrset.ID == change.RRSet.ID {
+				index = i
+				break
+			}
+		}
+
+		switch change.Action {
+		case DeltaUpsert:
+			if index < 0 {
+				zone.RRsets = append(zone.RRsets, change.RRSet)
+			} else {
+				zone.RRsets[index] = change.RRSet
+			}
+		case DeltaDelete:
+			if index >= 0 {
+				zone.RRsets = append(zone.RRsets[:index], zone.RRsets[index+1:]...)
+			}
+		default:
+			return fmt.Errorf("%w: unknown action %q", errDeltaGap, change.Action)
+		}
+	}
+
+	d.Domain.Serial = delta.Serial
+	return nil
+}
+
+func (d *DomainData) zoneByID(id int) *Zone {
+	for i := range d.Zones {
+		if d.Zones[i].ID == id {
+			return &d.Zones[i]
+		}
+	}
+	return nil
+}
+
+// fetchDomainChanges gets the deltas of a domain since a serial, oldest first
+func (c *Controller) fetchDomainChanges(id int, since string) ([]DomainDelta, error) {
+	deltas := make([]DomainDelta, 0)
+	err := c.getJSON(c.controllerURL()+"api/v1/domain/"+strconv.Itoa(id)+"/changes/?since="+since, &deltas)
+	if err != nil {
+		return nil, err
+	}
+
+	return deltas, nil
+}
+
+// syncDomain brings a domain up to the serial of a notification. Changes carried in the notification are
+// applied directly, otherwise they are fetched from the controller; the whole domain is refetched only
+// when the deltas can't be applied.
+func (c *Controller) syncDomain(notification WSNotification) (err error) {
+	id := notification.Domain
+	if notification.Serial == "" && notification.Delta == nil {
+		// controller doesn't send deltas
+		return c.loadDomainFromSource(id)
+	}
+
+	err = c.syncDomainDeltas(notification)
+	if err == nil {
+		return nil
+	}
+	log.Infof("Refetching domain id %d from %s: %v", id, c.name(), err)
+
+	return c.loadDomainFromSource(id)
+}
+
+func (c *Controller) syncDomainDeltas(notification WSNotification) (err error) {
+	defer func() { c.countSync("delta", err) }()
+
+	id := notification.Domain
+	if notification.Delta != nil {
+		return c.applyDeltas(id, []DomainDelta{*notification.Delta})
+	}
+
+	c.engine.updateLock.Lock()
+	current := c.domainByID(id)
+	c.engine.updateLock.Unlock()
+	if current == nil {
+		return fmt.Errorf("%w: domain id %d not loaded", errDeltaGap, id)
+	}
+	if current.Domain.Serial == notification.Serial {
+		log.Debugf("Domain id %d already at serial %s", id, notification.Serial)
+		return nil
+	}
+
+	deltas, err := c.fetchDomainChanges(id, current.Domain.Serial)
+	if err != nil {
+		return err
+	}
+	if len(deltas) == 0 || deltas[len(deltas)-1].Serial != notification.Serial {
+		return fmt.Errorf("%w: changes of domain id %d don't reach serial %s", errDeltaGap, id, notification.Serial)
+	}
+
+	err = c.applyDeltas(id, deltas)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Applied %d deltas of domain id %d from %s", len(deltas), id, c.name())
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package nexns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSyncDomainDeltas(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+
+	refetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/domain/1/changes/":
+			if r.URL.Query().Get("since") != "123456790" {
+				w.WriteHeader(http.StatusGone)
+				return
+			}
+			w.Write([]byte(`[{"domain": 1, "from_serial": "123456790", "serial": "123456791", "changes": [
+				{"zone": 11, "action": "upsert", "rrset": {"id": 114, "name": "dhcp", "type": "A", "records": [{"id": 5, "ttl": 60, "val": "10.0.0.5"}]}}
+			]}]`))
+		case "/api/v1/domain/1/dump/":
+			refetched++
+			w.Write([]byte(`{"domain": {"id": 1, "domain": "example.com", "serial": "123456800"}, "zones": []}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	e := buildTestingEngine(trie)
+	controller := buildTestingController(e, server.URL+"/")
+	original := e.Database().Search("example.com.")
+
+	// delta carried in the notification
+	err = controller.syncDomain(WSNotification{Domain: 1, Delta: &DomainDelta{
+		Domain: 1, FromSerial: "123456789", Serial: "123456790",
+		Changes: []RRSetChange{
+			{Zone: 11, Action: DeltaUpsert, RRSet: RRSet{ID: 111, Name: "www", Type: "A", Records: []Record{{ID: 1, TTL: 60, Data: "9.9.9.9"}}}},
+			{Zone: 11, Action: DeltaDelete, RRSet: RRSet{ID: 112}},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("Error applying delta: %s", err)
+	}
+	domainData := e.Database().Search("example.com.")
+	if domainData.Domain.Serial != "123456790" || len(domainData.Zones[0].RRsets) != 2 || domainData.Zones[0].RRsets[0].Records[0].Data != "9.9.9.9" {
+		t.Fatalf("Expected delta to be applied, got %+v", domainData)
+	}
+	if len(original.Zones[0].RRsets) != 3 || original.Zones[0].RRsets[0].Records[0].Data != "1.0.0.1" {
+		t.Fatalf("Expected data in the previous database not to be modified")
+	}
+
+	// only the new serial is notified, changes are fetched
+	err = controller.syncDomain(WSNotification{Domain: 1, Serial: "123456791"})
+	if err != nil {
+		t.Fatalf("Error syncing changes: %s", err)
+	}
+	domainData = e.Database().Search("example.com.")
+	if domainData.Domain.Serial != "123456791" || len(domainData.Zones[0].RRsets) != 3 {
+		t.Fatalf("Expected fetched changes to be applied, got %+v", domainData)
+	}
+	if refetched != 0 {
+		t.Fatalf("Expected no full refetch, got %d", refetched)
+	}
+
+	// a gap in the sequence falls back to refetching the domain
+	err = controller.syncDomain(WSNotification{Domain: 1, Delta: &DomainDelta{Domain: 1, FromSerial: "123456795", Serial: "123456796"}})
+	if err != nil {
+		t.Fatalf("Error refetching domain: %s", err)
+	}
+	if refetched != 1 || e.Database().Search("example.com.").Domain.Serial != "123456800" {
+		t.Fatalf("Expected domain to be refetched after a gap")
+	}
+}
@@ -0,0 +1,85 @@
+package nexns
+
+import (
+	"fmt"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// recordKey identifies a record within a domain
+type recordKey struct {
+	view  string
+	name  string
+	rtype string
+	id    int
+}
+
+func domainRecords(domainData *DomainData) map[recordKey]Record {
+	records := make(map[recordKey]Record)
+	if domainData == nil {
+		return records
+	}
+	for _, zone := range domainData.Zones {
+		for _, rrset := range zone.RRsets {
+			name := getFqdn(rrset.Name, domainData.Domain.Name)
+			for _, record := range rrset.Records {
+				records[recordKey{zone.Name, name, rrset.Type, record.ID}] = record
+			}
+		}
+	}
+	return records
+}
+
+// diffDomain describes the changes from old to new data of one domain, either may be nil
+func diffDomain(old *DomainData, new *DomainData) []string {
+	changes := make([]string, 0)
+
+	switch {
+	case old == nil && new == nil:
+		return changes
+	case old == nil:
+		changes = append(changes, fmt.Sprintf("domain %s added, serial %s", new.Domain.Name, new.Domain.Serial))
+	case new == nil:
+		changes = append(changes, fmt.Sprintf("domain %s removed", old.Domain.Name))
+	case old.Domain != new.Domain:
+		changes = append(changes, fmt.Sprintf("domain %s changed, serial %s -> %s", new.Domain.Name, old.Domain.Serial, new.Domain.Serial))
+	}
+
+	oldRecords := domainRecords(old)
+	newRecords := domainRecords(new)
+	for key, record := range newRecords {
+		oldRecord, exists := oldRecords[key]
+		if !exists {
+			changes = append(changes, fmt.Sprintf("record added: view %s %s %d %s %s", key.view, key.name, record.TTL, key.rtype, record.Data))
+		} else if oldRecord != record {
+			changes = append(changes, fmt.Sprintf("record changed: view %s %s %s %d %s -> %d %s", key.view, key.name, key.rtype, oldRecord.TTL, oldRecord.Data, record.TTL, record.Data))
+		}
+	}
+	for key, record := range oldRecords {
+		if _, exists := newRecords[key]; !exists {
+			changes = append(changes, fmt.Sprintf("record removed: view %s %s %d %s %s", key.view, key.name, record.TTL, key.rtype, record.Data))
+		}
+	}
+
+	return changes
+}
+
+// logDiff logs the changes between old and new domains at debug level
+func logDiff(old map[string]*DomainData, new map[string]*DomainData) {
+	if !clog.D.Value() {
+		return
+	}
+
+	for name, newData := range new {
+		for _, change := range diffDomain(old[name], newData) {
+			log.Debug(change)
+		}
+	}
+	for name, oldData := range old {
+		if _, exists := new[name]; !exists {
+			for _, change := range diffDomain(oldData, nil) {
+				log.Debug(change)
+			}
+		}
+	}
+}
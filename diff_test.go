@@ -0,0 +1,34 @@
+package nexns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffDomain(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+	old := trie.Search("example.com")
+
+	new := &DomainData{Domain: old.Domain}
+	new.Domain.Serial = "123456790"
+	new.Zones = []Zone{old.Zones[0]}
+	new.Zones[0].RRsets = []RRSet{old.Zones[0].RRsets[0], old.Zones[0].RRsets[1]}
+	new.Zones[0].RRsets[0].Records = []Record{{ID: 1, TTL: 60, Data: "1.0.0.9"}}
+
+	changes := strings.Join(diffDomain(old, new), "\n")
+	for _, expected := range []string{
+		"domain example.com changed, serial 123456789 -> 123456790",
+		"record changed: view default www.example.com. A 3600 1.0.0.1 -> 60 1.0.0.9",
+		"record removed: view default sub.www.example.com. 3600 A 1.0.0.3",
+	} {
+		if !strings.Contains(changes, expected) {
+			t.Fatalf("Expected change %q, got:\n%s", expected, changes)
+		}
+	}
+	if strings.Contains(changes, "ftp") {
+		t.Fatalf("Expected unchanged record not to be reported, got:\n%s", changes)
+	}
+}
@@ -0,0 +1,229 @@
+package nexns
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultEndpointRetry is how long a failed controller endpoint is skipped
+const DefaultEndpointRetry = 30 * time.Second
+
+// DefaultControllerFailback is how often higher priority endpoints are probed to fail back to them
+const DefaultControllerFailback = 1 * time.Minute
+
+// controllerEndpoints 是按优先级排列的 Controller 地址，第一个为首选
+type controllerEndpoints struct {
+	mu         sync.Mutex
+	controller string
+	urls       []string
+	active     int
+	downUntil  []time.Time
+	verify     bool          // active endpoint was switched to, its data is not checked yet
+	changed    chan struct{} // closed when the active endpoint changes
+}
+
+func newControllerEndpoints(controller string, urls []string) *controllerEndpoints {
+	return &controllerEndpoints{
+		controller: controller,
+		urls:       urls,
+		downUntil:  make([]time.Time, len(urls)),
+		changed:    make(chan struct{}),
+	}
+}
+
+// current returns the active endpoint
+func (e *controllerEndpoints) current() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.urls[e.active]
+}
+
+// watch returns a channel closed when the active endpoint changes
+func (e *controllerEndpoints) watch() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.changed
+}
+
+// index returns the endpoint a URL belongs to, or -1
+func (e *controllerEndpoints) index(rawURL string) int {
+	for i, u := range e.urls {
+		if strings.HasPrefix(rawURL, u) {
+			return i
+		}
+	}
+	return -1
+}
+
+// fail marks the endpoint of a URL down, switching away from it if it is active.
+// Endpoints which are not down are preferred, in priority order after the failed one.
+func (e *controllerEndpoints) fail(rawURL string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	failed := e.index(rawURL)
+	if failed < 0 {
+		return
+	}
+	e.downUntil[failed] = time.Now().Add(DefaultEndpointRetry)
+	if failed != e.active || len(e.urls) == 1 {
+		return
+	}
+
+	next := (failed + 1) % len(e.urls)
+	for i := 1; i < len(e.urls); i++ {
+		candidate := (failed + i) % len(e.urls)
+		if time.Now().After(e.downUntil[candidate]) {
+			next = candidate
+			break
+		}
+	}
+	log.Warningf("Controller %s failed, switching to %s", redactURL(e.urls[failed]), redactURL(e.urls[next]))
+	e.switchTo(next)
+}
+
+// failback switches to a higher priority endpoint which is up again
+func (e *controllerEndpoints) failback(index int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if index >= e.active {
+		return
+	}
+	log.Infof("Controller %s is up, failing back from %s", redactURL(e.urls[index]), redactURL(e.urls[e.active]))
+	e.downUntil[index] = time.Time{}
+	e.switchTo(index)
+}
+
+func (e *controllerEndpoints) switchTo(index int) {
+	endpointActiveGauge.WithLabelValues(e.controller, redactURL(e.urls[e.active])).Set(0)
+	endpointActiveGauge.WithLabelValues(e.controller, redactURL(e.urls[index])).Set(1)
+	e.active = index
+	e.verify = true
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// pending returns the active endpoint if its data must be checked before being applied
+func (e *controllerEndpoints) pending() (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.urls[e.active], e.verify
+}
+
+// verified marks the data of an endpoint checked, if it is still active
+func (e *controllerEndpoints) verified(url string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.urls[e.active] == url {
+		e.verify = false
+	}
+}
+
+// controllerURL returns the controller endpoint to use
+func (c *Controller) controllerURL() string {
+	if c.endpoints == nil {
+		return c.URLs[0]
+	}
+	return c.endpoints.current()
+}
+
+// checkResponse marks the endpoint of a request down if the request failed or the controller had an error
+func (c *Controller) checkResponse(req *http.Request, response *http.Response, err error) {
+	if c.endpoints == nil {
+		return
+	}
+	if err != nil || response.StatusCode >= 500 {
+		c.endpoints.fail(req.URL.String())
+	}
+}
+
+// serialBehind reports whether remote is an older serial than local, serials which are not numbers are not compared
+func serialBehind(local string, remote string) bool {
+	localSerial, err := strconv.ParseUint(local, 10, 64)
+	if err != nil {
+		return false
+	}
+	remoteSerial, err := strconv.ParseUint(remote, 10, 64)
+	if err != nil {
+		return false
+	}
+	return remoteSerial < localSerial
+}
+
+// checkSerials refuses data from an endpoint just switched to, if it is behind the local data for any domain,
+// so a lagging controller replica can't roll back records. The endpoint is failed over in that case.
+func (c *Controller) checkSerials(serials []DomainSerial) error {
+	if c.endpoints == nil {
+		return nil
+	}
+	endpoint, verify := c.endpoints.pending()
+	if !verify {
+		return nil
+	}
+
+	local := make(map[string]string)
+	c.engine.updateLock.Lock()
+	for name, domainData := range c.domains {
+		local[name] = domainData.Domain.Serial
+	}
+	c.engine.updateLock.Unlock()
+	for _, serial := range serials {
+		if serialBehind(local[serial.Name], serial.Serial) {
+			c.endpoints.fail(endpoint)
+			return fmt.Errorf("controller %s is behind, domain %s serial %s < %s",
+				redactURL(endpoint), serial.Name, serial.Serial, local[serial.Name])
+		}
+	}
+
+	c.endpoints.verified(endpoint)
+	return nil
+}
+
+// runControllerFailback probes the endpoints preferred over the active one until stop is closed
+func (c *Controller) runControllerFailback(stop <-chan struct{}) {
+	if c.endpoints == nil || len(c.endpoints.urls) < 2 {
+		return
+	}
+
+	ticker := time.NewTicker(DefaultControllerFailback)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.endpoints.mu.Lock()
+		active := c.endpoints.active
+		c.endpoints.mu.Unlock()
+
+		for i := 0; i < active; i++ {
+			if c.probeEndpoint(c.endpoints.urls[i]) {
+				c.endpoints.failback(i)
+				break
+			}
+		}
+	}
+}
+
+// probeEndpoint reports whether an endpoint answers the serial API
+func (c *Controller) probeEndpoint(endpoint string) bool {
+	req, err := c.newRequestWithCredentials(endpoint + "api/v1/domain/serial/")
+	if err != nil {
+		return false
+	}
+	response, err := c.httpClient().Do(req)
+	if err != nil {
+		log.Debugf("Controller %s still down: %v", redactURL(endpoint), err)
+		return false
+	}
+	response.Body.Close()
+	return response.StatusCode >= 200 && response.StatusCode <= 299
+}
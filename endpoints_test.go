@@ -0,0 +1,79 @@
+package nexns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestControllerFailover(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	// a replica which missed the latest change of example.com
+	lagging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/domain/dump/":
+			w.Write([]byte(`[{"domain": {"id": 1, "domain": "example.com", "serial": "123456780"}, "zones": []}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer lagging.Close()
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/domain/serial/":
+			w.Write([]byte(`[{"id": 1, "domain": "example.com", "serial": "123456790"}]`))
+		case "/api/v1/domain/1/dump/":
+			w.Write([]byte(`{"domain": {"id": 1, "domain": "example.com", "serial": "123456790"}, "zones": []}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer good.Close()
+
+	urls := []string{down.URL + "/", lagging.URL + "/", good.URL + "/"}
+	e := buildTestingEngine(trie)
+	controller := buildTestingController(e, urls...)
+	controller.endpoints = newControllerEndpoints(controller.name(), urls)
+
+	// preferred endpoint fails, the full load from the lagging one is refused
+	if err := controller.reconcile(); err == nil {
+		t.Fatalf("Expected data of lagging controller to be refused")
+	}
+	if domainData := e.Database().Search("example.com."); domainData == nil || domainData.Domain.Serial != "123456789" {
+		t.Fatalf("Expected example.com not to be rolled back")
+	}
+	if controller.controllerURL() != urls[2] {
+		t.Fatalf("Expected failover to %s, got %s", urls[2], controller.controllerURL())
+	}
+
+	if err := controller.reconcile(); err != nil {
+		t.Fatalf("Error reconciling: %s", err)
+	}
+	if domainData := e.Database().Search("example.com."); domainData == nil || domainData.Domain.Serial != "123456790" {
+		t.Fatalf("Expected example.com to be updated")
+	}
+
+	controller.endpoints.failback(0)
+	if controller.controllerURL() != urls[0] {
+		t.Fatalf("Expected failback to %s, got %s", urls[0], controller.controllerURL())
+	}
+}
+
+func TestSerialBehind(t *testing.T) {
+	if !serialBehind("2024010102", "2024010101") {
+		t.Fatalf("Expected older serial to be behind")
+	}
+	if serialBehind("2024010101", "2024010102") || serialBehind("", "1") || serialBehind("a", "1") {
+		t.Fatalf("Expected newer or unknown serial not to be behind")
+	}
+}
@@ -0,0 +1,306 @@
+package nexns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// syncEngine 同步一组 Controller 的数据并合并为一个 Trie。Controller 与健康检查配置相同的多个 server block
+// 共用一个 syncEngine，Trie 每次变更时整体替换、从不原地修改，查询无需加锁
+type syncEngine struct {
+	key           string
+	Controllers   []*Controller // 按声明顺序排列
+	SnapshotPath  string
+	OverridesPath string // 本地覆盖文件
+
+	// 健康检查与主备切换，共用 syncEngine 的 server block 共享探测结果与记录池状态
+	HealthChecks   map[string]*HealthCheck // 按名称，Corefile 中配置
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	FailbackDelay  time.Duration
+
+	database     atomic.Pointer[Trie]
+	updateLock   sync.Mutex
+	snapshotLock sync.Mutex
+	overrides    []Override // guarded by updateLock
+	refs         int        // guarded by enginesLock
+	stop         chan struct{}
+
+	snapshotDirty chan struct{} // 快照已过期，等待写入
+	snapshotDone  chan struct{} // 最后一次写入快照后关闭
+
+	health       healthStatus
+	started      atomic.Bool // start 已调用
+	healthWanted atomic.Bool // 数据中出现过健康检查或多个记录池
+	healthOnce   sync.Once
+	healthLabels map[string][]string // 本 syncEngine 探测的 healthStatusGauge 标签，guarded by healthSeriesLock
+	pools        sync.Map            // rrsetKey -> *poolState
+}
+
+var (
+	enginesLock sync.Mutex
+	engines     = make(map[string]*syncEngine)
+)
+
+func newSyncEngine(snapshotPath string) *syncEngine {
+	e := &syncEngine{
+		SnapshotPath:   snapshotPath,
+		HealthChecks:   make(map[string]*HealthCheck),
+		HealthInterval: DefaultHealthInterval,
+		HealthTimeout:  DefaultHealthTimeout,
+		FailbackDelay:  DefaultFailbackDelay,
+		stop:           make(chan struct{}),
+		snapshotDirty:  make(chan struct{}, 1),
+	}
+	e.database.Store(BuildTrie(nil))
+	return e
+}
+
+// Database returns the current database, which must not be modified
+func (e *syncEngine) Database() *Trie {
+	return e.database.Load()
+}
+
+// Ready reports whether data of every controller was loaded or restored from snapshot
+func (e *syncEngine) Ready() bool {
+	for _, controller := range e.Controllers {
+		if !controller.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// engineKey identifies the controller settings of an engine, engines with equal keys sync the same data
+func (e *syncEngine) engineKey() string {
+	keys := make([]string, 0, len(e.Controllers)+1)
+	keys = append(keys, fmt.Sprintf("snapshot %q overrides %q", e.SnapshotPath, e.OverridesPath))
+	keys = append(keys, fmt.Sprintf("health interval %s timeout %s failback %s", e.HealthInterval, e.HealthTimeout, e.FailbackDelay))
+	names := make([]string, 0, len(e.HealthChecks))
+	for name := range e.HealthChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		keys = append(keys, fmt.Sprintf("health_check %s %+v", name, *e.HealthChecks[name]))
+	}
+	for _, controller := range e.Controllers {
+		keys = append(keys, controller.key())
+	}
+	return strings.Join(keys, "\n")
+}
+
+// acquireEngine returns the running engine with the same settings as e, starting e if there is none
+func acquireEngine(e *syncEngine) *syncEngine {
+	enginesLock.Lock()
+	defer enginesLock.Unlock()
+
+	e.key = e.engineKey()
+	if running, exists := engines[e.key]; exists {
+		running.refs++
+		log.Debugf("Sharing controller sync, %d users", running.refs)
+		return running
+	}
+
+	e.refs = 1
+	engines[e.key] = e
+	e.start()
+	return e
+}
+
+// release stops the engine once no plugin uses it anymore, after writing pending snapshot updates
+func (e *syncEngine) release() {
+	enginesLock.Lock()
+	e.refs--
+	if e.refs > 0 {
+		enginesLock.Unlock()
+		return
+	}
+	delete(engines, e.key)
+	close(e.stop)
+	enginesLock.Unlock()
+
+	if e.snapshotDone != nil {
+		<-e.snapshotDone
+	}
+}
+
+// start loads the snapshot and syncs every controller in background
+func (e *syncEngine) start() {
+	// serve from snapshot first if there is one, and keep it up to date
+	if e.SnapshotPath != "" {
+		err := e.loadSnapshot()
+		if err != nil {
+			log.Warningf("Failed to load snapshot: %v", err)
+		}
+		e.snapshotDone = make(chan struct{})
+		go e.runSnapshots()
+	}
+
+	// local overrides apply on top of the data of all controllers
+	if e.OverridesPath != "" {
+		go e.runOverrides()
+	}
+
+	// probe health checked records, once the Corefile or the data configures any
+	e.started.Store(true)
+	if len(e.HealthChecks) > 0 || e.healthWanted.Load() {
+		e.startHealthChecks()
+	}
+
+	// each controller syncs independently
+	for _, controller := range e.Controllers {
+		controller.start(e.stop)
+		log.Infof("Init success. Data source %s", controller.name())
+	}
+}
+
+// owner returns the controller whose data of a domain is served and that data, nil if no controller
+// publishes it. The domains of pending, a dump being merged, replace those of its controller.
+func (e *syncEngine) owner(name string, pending *dumpMerge) (*Controller, *DomainData) {
+	var owner *Controller
+	var ownerData *DomainData
+	for _, controller := range e.Controllers {
+		domains := controller.domains
+		if pending != nil && pending.controller == controller {
+			domains = pending.domains
+		}
+		domainData, exists := domains[name]
+		if !exists {
+			continue
+		}
+		if owner == nil || controller.Precedence > owner.Precedence {
+			owner = controller
+			ownerData = domainData
+		}
+	}
+	return owner, ownerData
+}
+
+// mergeDomains replaces the database with a copy updated for domains whose data changed on some controller,
+// with updateLock held. The controller with the highest precedence publishing a domain wins.
+func (e *syncEngine) mergeDomains(names []string) {
+	database := e.Database()
+	editor := database.edit()
+
+	old := make(map[string]*DomainData)
+	new := make(map[string]*DomainData)
+	e.mergeInto(editor, database, names, nil, old, new)
+
+	e.database.Store(editor.trie)
+	logDiff(old, new)
+}
+
+// mergeInto updates editor, a copy of database, for domains, with updateLock held. Replaced and new data
+// are recorded in old and new.
+func (e *syncEngine) mergeInto(editor *trieEditor, database *Trie, names []string, pending *dumpMerge, old map[string]*DomainData, new map[string]*DomainData) {
+	merged := make(map[string]bool, len(names))
+
+	for _, name := range names {
+		if merged[name] {
+			continue
+		}
+		merged[name] = true
+
+		current := database.Search(name)
+		if current != nil && current.Domain.Name != name {
+			current = nil
+		}
+		if current != nil {
+			old[name] = current
+		}
+
+		owner, ownerData := e.owner(name, pending)
+		if owner == nil {
+			if current != nil {
+				editor.Delete(name)
+			}
+			continue
+		}
+
+		domainData := e.applyOverrides(ownerData)
+		if current != nil && current.Source != owner.name() {
+			log.Infof("Domain %s is now served from controller %s instead of %s", name, owner.name(), current.Source)
+		}
+		editor.Insert(domainData)
+		new[name] = domainData
+		if needsHealthChecks(domainData) {
+			e.healthWanted.Store(true)
+			if e.started.Load() {
+				e.startHealthChecks()
+			}
+		}
+	}
+}
+
+// dumpMerge merges a full dump of a controller into a copy of the database one domain at a time, while
+// the dump is decoded. The database and the domains of the controller are replaced only by finish, so
+// a broken dump never replaces part of the data.
+type dumpMerge struct {
+	controller *Controller
+	database   *Trie // the copy is based on
+	editor     *trieEditor
+	domains    map[string]*DomainData // domains of the dump
+	old        map[string]*DomainData
+	new        map[string]*DomainData
+}
+
+func (c *Controller) newDumpMerge() *dumpMerge {
+	database := c.engine.Database()
+	return &dumpMerge{
+		controller: c,
+		database:   database,
+		editor:     database.edit(),
+		domains:    make(map[string]*DomainData),
+		old:        make(map[string]*DomainData),
+		new:        make(map[string]*DomainData),
+	}
+}
+
+// add merges a decoded domain into the copy of the database
+func (m *dumpMerge) add(domainData *DomainData) {
+	e := m.controller.engine
+	e.updateLock.Lock()
+	defer e.updateLock.Unlock()
+
+	domainData.Source = m.controller.name()
+	m.domains[domainData.Domain.Name] = domainData
+	e.mergeInto(m.editor, m.database, []string{domainData.Domain.Name}, m, m.old, m.new)
+}
+
+// finish replaces the domains of the controller with the dump, and the database with the copy
+func (m *dumpMerge) finish() {
+	c := m.controller
+	e := c.engine
+	e.updateLock.Lock()
+
+	removed := make([]string, 0)
+	for name := range c.domains {
+		if _, exists := m.domains[name]; !exists {
+			removed = append(removed, name)
+		}
+	}
+
+	if e.Database() == m.database {
+		e.mergeInto(m.editor, m.database, removed, m, m.old, m.new)
+		c.domains = m.domains
+		e.database.Store(m.editor.trie)
+		logDiff(m.old, m.new)
+	} else {
+		// the database changed while the dump was decoded, the copy is outdated
+		names := removed
+		for name := range m.domains {
+			names = append(names, name)
+		}
+		c.domains = m.domains
+		e.mergeDomains(names)
+	}
+
+	e.updateLock.Unlock()
+	c.ready.Store(true)
+	e.updateSnapshot()
+}
@@ -0,0 +1,107 @@
+package nexns
+
+import (
+	"fmt"
+	"testing"
+)
+
+// buildTestingEngine returns an engine serving the trie, without controllers
+func buildTestingEngine(trie *Trie) *syncEngine {
+	e := newSyncEngine("")
+	e.database.Store(trie)
+	return e
+}
+
+func TestEngineSharing(t *testing.T) {
+	build := func(secret string) *syncEngine {
+		e := newSyncEngine("")
+		controller := newController(e)
+		controller.URLs = []string{"http://127.0.0.1:1/"}
+		controller.ClientSecret = secret
+		controller.SyncMode = SyncPoll
+		controller.PollInterval = 1 << 62
+		controller.ReconcileInterval = 0
+		e.Controllers = []*Controller{controller}
+		return e
+	}
+
+	first := acquireEngine(build("secret"))
+	second := acquireEngine(build("secret"))
+	other := acquireEngine(build("other"))
+	if first != second {
+		t.Fatalf("Expected plugins with identical controller settings to share an engine")
+	}
+	if first == other {
+		t.Fatalf("Expected plugins with different credentials not to share an engine")
+	}
+	checked := build("secret")
+	checked.HealthChecks["www.example.com."] = &HealthCheck{Type: HealthCheckTCP, Port: 80}
+	checked = acquireEngine(checked)
+	if checked == first {
+		t.Fatalf("Expected plugins with different health checks not to share an engine")
+	}
+	checked.release()
+
+	first.release()
+	select {
+	case <-second.stop:
+		t.Fatalf("Expected engine to keep running while used")
+	default:
+	}
+	second.release()
+	other.release()
+	select {
+	case <-second.stop:
+	default:
+		t.Fatalf("Expected engine to stop when no longer used")
+	}
+	if len(engines) != 0 {
+		t.Fatalf("Expected released engines to be forgotten, got %d", len(engines))
+	}
+}
+
+func TestTrieEditorCopyOnWrite(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+
+	editor := trie.edit()
+	editor.Insert(&DomainData{Domain: Domain{ID: 9, Name: "new.example.com"}})
+	editor.Delete("test.com")
+	editor.Delete("sub.example.com")
+	edited := editor.trie
+
+	// original is unchanged
+	if domainData := trie.Search("www.new.example.com."); domainData == nil || domainData.Domain.ID != 1 {
+		t.Fatalf("Expected original trie not to see inserted domain")
+	}
+	if trie.Search("www.test.com.") == nil || trie.Search("www.sub.example.com.").Domain.ID != 2 {
+		t.Fatalf("Expected original trie to keep deleted domains")
+	}
+
+	if domainData := edited.Search("www.new.example.com."); domainData == nil || domainData.Domain.ID != 9 {
+		t.Fatalf("Expected copy to serve inserted domain")
+	}
+	if edited.Search("www.test.com.") != nil {
+		t.Fatalf("Expected copy not to serve deleted domain")
+	}
+	if domainData := edited.Search("www.sub.example.com."); domainData == nil || domainData.Domain.ID != 1 {
+		t.Fatalf("Expected copy to fall back to parent of deleted domain")
+	}
+}
+
+func BenchmarkTrieEdit(b *testing.B) {
+	domains := make([]DomainData, 100000)
+	for i := range domains {
+		domains[i] = DomainData{Domain: Domain{ID: i + 1, Name: fmt.Sprintf("domain-%d.com", i)}}
+	}
+	trie := BuildTrie(domains)
+
+	// a single change copies the children of the root and of com
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		editor := trie.edit()
+		editor.Insert(&DomainData{Domain: Domain{ID: 1, Name: "domain-0.com"}})
+	}
+}
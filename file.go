@@ -0,0 +1,163 @@
+package nexns
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultFileInterval is how often data files are checked for changes
+const DefaultFileInterval = 5 * time.Second
+
+// fileSource reads domains from a JSON file in the format of the dump endpoint, or from every *.json file of
+// a directory. Files are polled for changes, so edits apply without restarting CoreDNS.
+type fileSource struct {
+	path     string
+	interval time.Duration
+}
+
+func newFileSource(path string) *fileSource {
+	return &fileSource{path: path, interval: DefaultFileInterval}
+}
+
+func (s *fileSource) String() string {
+	return s.path
+}
+
+// files returns the data files, the path itself or the JSON files of the directory in name order
+func (s *fileSource) files() ([]string, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{s.path}, nil
+	}
+
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		files = append(files, filepath.Join(s.path, entry.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s *fileSource) LoadAll() ([]*DomainData, error) {
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+
+	domainDataList := make([]*DomainData, 0)
+	loaded := make(map[string]string)
+	for _, file := range files {
+		list, err := readDomainFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, domainData := range list {
+			if other, exists := loaded[domainData.Domain.Name]; exists {
+				return nil, fmt.Errorf("%s: domain %s already defined in %s", file, domainData.Domain.Name, other)
+			}
+			loaded[domainData.Domain.Name] = file
+			domainDataList = append(domainDataList, domainData)
+		}
+	}
+
+	return domainDataList, nil
+}
+
+// readDomainFile decodes a JSON list of domains from a file
+func readDomainFile(file string) ([]*DomainData, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	domainDataList := make([]*DomainData, 0)
+	err = json.NewDecoder(f).Decode(&domainDataList)
+	if err != nil {
+		return nil, fmt.Errorf("%s: JSON parsing error: %v", file, err)
+	}
+	for _, domainData := range domainDataList {
+		if domainData == nil || domainData.Domain.Name == "" {
+			return nil, fmt.Errorf("%s: domain without name", file)
+		}
+	}
+
+	return domainDataList, nil
+}
+
+func (s *fileSource) LoadDomain(id int) (*DomainData, error) {
+	domainDataList, err := s.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, domainData := range domainDataList {
+		if domainData.Domain.ID == id {
+			return domainData, nil
+		}
+	}
+	return nil, fmt.Errorf("domain id %d not found in %s", id, s.path)
+}
+
+// filesState describes name, size and modification time of data files, it changes with any edit
+func filesState(files []string) string {
+	var state strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			fmt.Fprintf(&state, "%s %v\n", file, err)
+			continue
+		}
+		fmt.Fprintf(&state, "%s %d %d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return state.String()
+}
+
+// watchFiles calls changed(0) once, then whenever the state of the data files changes, until stop is closed
+func watchFiles(stop <-chan struct{}, interval time.Duration, description string, state func() string, changed func(id int) error) {
+	last := state()
+	changed(0)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		current := state()
+		if current == last {
+			continue
+		}
+		log.Infof("Data files of %s changed, reloading.", description)
+		last = current
+		changed(0)
+	}
+}
+
+func (s *fileSource) Watch(stop <-chan struct{}, changed func(id int) error) {
+	watchFiles(stop, s.interval, s.path, func() string {
+		files, err := s.files()
+		if err != nil {
+			return err.Error()
+		}
+		return filesState(files)
+	}, changed)
+}
@@ -0,0 +1,65 @@
+package nexns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSource(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("Error writing %s: %s", name, err)
+		}
+	}
+	write("a.json", `[{"domain": {"id": 1, "domain": "example.com", "serial": "1"}, "zones": []}]`)
+	write("b.json", `[{"domain": {"id": 2, "domain": "test.com", "serial": "1"}, "zones": []}]`)
+	write("notes.txt", `not data`)
+
+	e := newSyncEngine("")
+	controller := newController(e)
+	source := newFileSource(dir)
+	source.interval = 10 * time.Millisecond
+	controller.source = source
+	e.Controllers = []*Controller{controller}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	controller.start(stop)
+
+	waitFor := func(check func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if check() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	if !waitFor(func() bool { return e.Ready() && e.Database().Search("test.com.") != nil }) {
+		t.Fatalf("Expected domains of all files to be loaded")
+	}
+	if domainData := e.Database().Search("example.com."); domainData == nil || domainData.Source != dir {
+		t.Fatalf("Expected example.com from file source")
+	}
+
+	// edits apply live
+	write("b.json", `[{"domain": {"id": 2, "domain": "test.com", "serial": "2"}, "zones": []}, {"domain": {"id": 3, "domain": "new.com", "serial": "1"}, "zones": []}]`)
+	if !waitFor(func() bool { return e.Database().Search("new.com.") != nil }) {
+		t.Fatalf("Expected edited file to be reloaded")
+	}
+
+	// a broken edit keeps the current data
+	write("c.json", `[{"domain": {"id": 4, "domain": "example.com", "serial": "2"}, "zones": []}]`)
+	time.Sleep(50 * time.Millisecond)
+	if domainData := e.Database().Search("example.com."); domainData == nil || domainData.Domain.ID != 1 {
+		t.Fatalf("Expected data to be kept when a domain is defined twice")
+	}
+	if _, err := source.LoadAll(); err == nil {
+		t.Fatalf("Expected duplicate domain to be refused")
+	}
+}
@@ -0,0 +1,175 @@
+package nexns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// notifyGRPCMethod is a bidirectional stream: the controller sends WSNotification messages, the plugin
+// answers each with a NotifyAck. Messages are JSON encoded, with content type application/grpc+json.
+const notifyGRPCMethod = "/nexns.v1.Notification/Subscribe"
+
+// gRPC keepalive 探测间隔与超时。grpc-go 服务端缺省拒绝间隔小于 5 分钟的探测（EnforcementPolicy.MinTime），
+// 并以 too_many_pings 断开连接
+const (
+	notifyGRPCKeepalive        = 5 * time.Minute
+	notifyGRPCKeepaliveTimeout = 20 * time.Second
+)
+
+var notifyGRPCStream = &grpc.StreamDesc{
+	StreamName:    "Subscribe",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// jsonCodec encodes gRPC messages as JSON, so the plugin needs no generated protobuf code
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// grpcSource receives notifications over a gRPC stream and acknowledges each of them
+type grpcSource struct {
+	controller *Controller
+	address    string // host:port of the gRPC service, defaults to the controller endpoint
+
+	conn      *grpc.ClientConn
+	stream    grpc.ClientStream
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// grpcTarget returns the address of the gRPC service and whether to use TLS for a controller endpoint
+func (s *grpcSource) grpcTarget(endpoint string) (string, bool, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", false, err
+	}
+	secure := u.Scheme == "https"
+
+	if s.address != "" {
+		return s.address, secure, nil
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if secure {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), secure, nil
+}
+
+func (s *grpcSource) connect(endpoint string) (bool, error) {
+	c := s.controller
+
+	target, secure, err := s.grpcTarget(endpoint)
+	if err != nil {
+		return false, err
+	}
+	transportCredentials := insecure.NewCredentials()
+	scheme := "http"
+	if secure {
+		transportCredentials = credentials.NewTLS(c.tlsClientConfig())
+		scheme = "https"
+	}
+
+	// credentials are sent as metadata, signed like an HTTP request to the method
+	req, err := http.NewRequest(http.MethodPost, scheme+"://"+target+notifyGRPCMethod, nil)
+	if err != nil {
+		return false, err
+	}
+	err = c.authenticator().Authenticate(req)
+	if err != nil {
+		return false, fmt.Errorf("authenticate request error: %v", err)
+	}
+	md := metadata.MD{}
+	for key, values := range req.Header {
+		md.Append(strings.ToLower(key), values...)
+	}
+
+	conn, err := grpc.NewClient(target,
+		grpc.WithTransportCredentials(transportCredentials),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: notifyGRPCKeepalive, Timeout: notifyGRPCKeepaliveTimeout}),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(context.Background(), md))
+	stream, err := conn.NewStream(ctx, notifyGRPCStream, notifyGRPCMethod)
+	if err != nil {
+		cancel()
+		conn.Close()
+		return status.Code(err) == codes.Unavailable, grpcError(err)
+	}
+
+	s.conn = conn
+	s.stream = stream
+	s.cancel = cancel
+	return false, nil
+}
+
+// grpcError marks errors of refused credentials, so they are not retried quickly
+func grpcError(err error) error {
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return fmt.Errorf("%w: %v", errNotifyRejected, err)
+	}
+	return err
+}
+
+func (s *grpcSource) receive() (*WSNotification, error) {
+	notificationData := &WSNotification{}
+	err := s.stream.RecvMsg(notificationData)
+	if err != nil {
+		if status.Code(err) == codes.Unauthenticated {
+			s.controller.checkUnauthorized(&http.Response{StatusCode: http.StatusUnauthorized})
+		}
+		return nil, grpcError(err)
+	}
+	s.controller.notifyState.seen()
+
+	return notificationData, nil
+}
+
+func (s *grpcSource) ack(notification *WSNotification, applyErr error) error {
+	return s.stream.SendMsg(s.controller.ackFor(notification, applyErr))
+}
+
+// ping is not needed, gRPC keepalive detects dead connections
+func (s *grpcSource) ping() error {
+	return nil
+}
+
+func (s *grpcSource) close() {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.conn.Close()
+	})
+}
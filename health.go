@@ -0,0 +1,333 @@
+package nexns
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 健康检查方式
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+	HealthCheckUDP  = "udp"
+)
+
+const DefaultHealthInterval = 10 * time.Second
+const DefaultHealthTimeout = 2 * time.Second
+
+// 同时进行的健康检查探测数上限
+const HealthCheckConcurrency = 16
+
+// HealthCheck 描述了对 A/AAAA 记录地址的主动健康检查
+type HealthCheck struct {
+	Type    string `json:"type"`
+	Port    int    `json:"port"`
+	Path    string `json:"path"`    // http: 请求路径
+	Status  int    `json:"status"`  // http: 期望的状态码，缺省为 200
+	Payload string `json:"payload"` // udp: 探测报文，收到任意回复即为健康
+}
+
+func (hc *HealthCheck) check() error {
+	switch hc.Type {
+	case HealthCheckTCP, HealthCheckUDP, HealthCheckHTTP:
+	default:
+		return fmt.Errorf("unknown health check type: %s", hc.Type)
+	}
+	if hc.Port <= 0 || hc.Port > 65535 {
+		return fmt.Errorf("invalid health check port: %d", hc.Port)
+	}
+	return nil
+}
+
+func (hc *HealthCheck) path() string {
+	if hc.Path == "" {
+		return "/"
+	}
+	return hc.Path
+}
+
+func (hc *HealthCheck) status() int {
+	if hc.Status == 0 {
+		return http.StatusOK
+	}
+	return hc.Status
+}
+
+// key identifies the probe of one address, shared by records with the same check
+func (hc *HealthCheck) key(address string) string {
+	return hc.Type + "|" + net.JoinHostPort(address, strconv.Itoa(hc.Port)) + "|" + hc.path() + "|" + strconv.Itoa(hc.status()) + "|" + hc.Payload
+}
+
+// probe runs the check against address once
+func (hc *HealthCheck) probe(name string, address string, timeout time.Duration) error {
+	hostPort := net.JoinHostPort(address, strconv.Itoa(hc.Port))
+
+	switch hc.Type {
+
+	case HealthCheckTCP:
+		conn, err := net.DialTimeout("tcp", hostPort, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case HealthCheckHTTP:
+		req, err := http.NewRequest("GET", "http://"+hostPort+hc.path(), nil)
+		if err != nil {
+			return err
+		}
+		req.Host = strings.TrimSuffix(name, ".")
+
+		client := &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		response, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode != hc.status() {
+			return fmt.Errorf("unexpected status %d", response.StatusCode)
+		}
+		return nil
+
+	case HealthCheckUDP:
+		conn, err := net.DialTimeout("udp", hostPort, timeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write([]byte(hc.Payload)); err != nil {
+			return err
+		}
+		buf := make([]byte, 512)
+		_, err = conn.Read(buf)
+		return err
+	}
+
+	return fmt.Errorf("unknown health check type: %s", hc.Type)
+}
+
+// healthTarget is one address to probe
+type healthTarget struct {
+	check   *HealthCheck
+	name    string
+	address string
+}
+
+// healthStatus holds probe results, keyed by HealthCheck.key
+type healthStatus struct {
+	status sync.Map // string -> bool
+}
+
+// healthy reports whether the address passed its last probe, unknown addresses count as healthy
+func (hs *healthStatus) healthy(check *HealthCheck, address string) bool {
+	ok, exists := hs.status.Load(check.key(address))
+	return !exists || ok.(bool)
+}
+
+// healthCheckFor returns the controller's check of the RRset, else the Corefile's check of its name
+func (e *syncEngine) healthCheckFor(domain *Domain, rrset *RRSet) *HealthCheck {
+	if rrset.Type != "A" && rrset.Type != "AAAA" {
+		return nil
+	}
+	if rrset.HealthCheck != nil && rrset.HealthCheck.check() == nil {
+		return rrset.HealthCheck
+	}
+	return e.HealthChecks[getFqdn(rrset.Name, domain.Name)]
+}
+
+// recordAvailable reports whether record is not marked down and passes its health check
+func (e *syncEngine) recordAvailable(check *HealthCheck, record *Record) bool {
+	if record.Down {
+		return false
+	}
+	return check == nil || e.health.healthy(check, record.Data)
+}
+
+// healthyRecords returns the records of rrset which are not marked down and pass their health check.
+// If no record is left, all records are returned (fail-open).
+func (e *syncEngine) healthyRecords(domain *Domain, rrset *RRSet) []Record {
+	records := make([]Record, 0, len(rrset.Records))
+
+	check := e.healthCheckFor(domain, rrset)
+	for i := range rrset.Records {
+		if e.recordAvailable(check, &rrset.Records[i]) {
+			records = append(records, rrset.Records[i])
+		}
+	}
+
+	if len(records) == 0 {
+		return append(records, rrset.Records...)
+	}
+	return records
+}
+
+// healthTargets collects the addresses of every health checked record in the database
+func (e *syncEngine) healthTargets() map[string]healthTarget {
+	targets := make(map[string]healthTarget)
+
+	e.Database().Walk(func(domainData *DomainData) {
+		for _, zone := range domainData.Zones {
+			for i := range zone.RRsets {
+				rrset := &zone.RRsets[i]
+				check := e.healthCheckFor(&domainData.Domain, rrset)
+				if check == nil {
+					continue
+				}
+				for _, record := range rrset.Records {
+					targets[check.key(record.Data)] = healthTarget{
+						check:   check,
+						name:    getFqdn(rrset.Name, domainData.Domain.Name),
+						address: record.Data,
+					}
+				}
+			}
+		}
+	})
+
+	return targets
+}
+
+// needsHealthChecks reports whether domainData has a health checked RRset or an RRset with backup pools
+func needsHealthChecks(domainData *DomainData) bool {
+	for _, zone := range domainData.Zones {
+		for _, rrset := range zone.RRsets {
+			if rrset.HealthCheck != nil && (rrset.Type == "A" || rrset.Type == "AAAA") {
+				return true
+			}
+			for _, record := range rrset.Records {
+				if record.Pool != rrset.Records[0].Pool {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// startHealthChecks starts the health check loop unless it is running
+func (e *syncEngine) startHealthChecks() {
+	e.healthOnce.Do(func() {
+		go e.runHealthChecks()
+	})
+}
+
+// runHealthChecks probes all targets every HealthInterval until the engine stops. Server blocks sharing
+// the engine share the results, so each address is probed once.
+func (e *syncEngine) runHealthChecks() {
+	ticker := time.NewTicker(e.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		e.probeHealthTargets()
+
+		select {
+		case <-e.stop:
+			e.updateHealthGauge(nil)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *syncEngine) probeHealthTargets() {
+	targets := e.healthTargets()
+
+	var wg sync.WaitGroup
+	probes := make(chan struct{}, HealthCheckConcurrency)
+	for key, target := range targets {
+		wg.Add(1)
+		probes <- struct{}{}
+		go func(key string, target healthTarget) {
+			defer wg.Done()
+			defer func() { <-probes }()
+
+			err := target.check.probe(target.name, target.address, e.HealthTimeout)
+			healthy := err == nil
+
+			if was, exists := e.health.status.Load(key); !exists || was.(bool) != healthy {
+				if healthy {
+					log.Infof("Health check %s %s of %s passed", target.check.Type, target.address, target.name)
+				} else {
+					log.Warningf("Health check %s %s of %s failed: %v", target.check.Type, target.address, target.name, err)
+				}
+			}
+			e.health.status.Store(key, healthy)
+
+			result := "success"
+			if !healthy {
+				result = "failure"
+			}
+			healthCheckCount.WithLabelValues(target.check.Type, result).Inc()
+		}(key, target)
+	}
+	wg.Wait()
+
+	// forget addresses which are no longer in the database
+	e.health.status.Range(func(key, _ interface{}) bool {
+		if _, exists := targets[key.(string)]; !exists {
+			e.health.status.Delete(key)
+		}
+		return true
+	})
+	e.updateHealthGauge(targets)
+
+	e.updatePools(time.Now())
+}
+
+// healthSeries counts the engines probing the address of each health status series
+var (
+	healthSeriesLock sync.Mutex
+	healthSeries     = make(map[string]int)
+)
+
+// updateHealthGauge sets the health status series of the targets. A series is deleted once no engine
+// probes its address anymore, so engines of other server blocks or of a reload keep theirs.
+func (e *syncEngine) updateHealthGauge(targets map[string]healthTarget) {
+	labels := make(map[string][]string, len(targets))
+	for key, target := range targets {
+		if ok, exists := e.health.status.Load(key); exists {
+			values := []string{target.name, target.address, target.check.Type}
+			labels[strings.Join(values, "|")] = values
+			healthStatusGauge.WithLabelValues(values...).Set(boolToFloat(ok.(bool)))
+		}
+	}
+
+	healthSeriesLock.Lock()
+	defer healthSeriesLock.Unlock()
+
+	for key := range labels {
+		if _, exists := e.healthLabels[key]; !exists {
+			healthSeries[key]++
+		}
+	}
+	for key, values := range e.healthLabels {
+		if _, exists := labels[key]; exists {
+			continue
+		}
+		healthSeries[key]--
+		if healthSeries[key] <= 0 {
+			delete(healthSeries, key)
+			healthStatusGauge.DeleteLabelValues(values...)
+		}
+	}
+	e.healthLabels = labels
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,136 @@
+package nexns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHealthyRecordsFailOpen(t *testing.T) {
+	rrset, err := buildTestingRRset(OrderFixed, 0)
+	if err != nil {
+		t.Fatalf("Error building test rrset: %s", err)
+	}
+	check := &HealthCheck{Type: HealthCheckTCP, Port: 80}
+	rrset.HealthCheck = check
+
+	e := newSyncEngine("")
+	domain := &Domain{Name: "example.com"}
+
+	e.health.status.Store(check.key("1.0.0.1"), false)
+	records := e.healthyRecords(domain, rrset)
+	if len(records) != 2 || records[0].ID != 2 || records[1].ID != 3 {
+		t.Fatalf("Expected unhealthy record 1 to be removed, got %v", records)
+	}
+
+	e.health.status.Store(check.key("1.0.0.2"), false)
+	e.health.status.Store(check.key("1.0.0.3"), false)
+	records = e.healthyRecords(domain, rrset)
+	if len(records) != 3 {
+		t.Fatalf("Expected all records when none is healthy, got %v", records)
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	check := &HealthCheck{Type: HealthCheckTCP, Port: port}
+	if err := check.probe("www.example.com.", "127.0.0.1", time.Second); err != nil {
+		t.Fatalf("Expected probe to pass, got %s", err)
+	}
+
+	listener.Close()
+	if err := check.probe("www.example.com.", "127.0.0.1", time.Second); err == nil {
+		t.Fatalf("Expected probe to fail after listener closed")
+	}
+}
+
+func TestHealthGaugeSharedSeries(t *testing.T) {
+	count := func() int {
+		ch := make(chan prometheus.Metric, 16)
+		healthStatusGauge.Collect(ch)
+		close(ch)
+		return len(ch)
+	}
+
+	check := &HealthCheck{Type: HealthCheckTCP, Port: 80}
+	targets := map[string]healthTarget{
+		check.key("192.0.2.1"): {check: check, name: "www.example.com.", address: "192.0.2.1"},
+		check.key("192.0.2.2"): {check: check, name: "www.example.com.", address: "192.0.2.2"},
+	}
+	first := newSyncEngine("")
+	second := newSyncEngine("")
+	for key := range targets {
+		first.health.status.Store(key, true)
+		second.health.status.Store(key, true)
+	}
+	first.updateHealthGauge(targets)
+	second.updateHealthGauge(map[string]healthTarget{check.key("192.0.2.2"): targets[check.key("192.0.2.2")]})
+	if count() != 2 {
+		t.Fatalf("Expected series of both engines, got %d", count())
+	}
+
+	// the first engine stops probing an address, the series the second engine probes stays
+	first.updateHealthGauge(map[string]healthTarget{check.key("192.0.2.1"): targets[check.key("192.0.2.1")]})
+	if count() != 2 {
+		t.Fatalf("Expected series still probed by another engine to stay, got %d", count())
+	}
+	first.updateHealthGauge(map[string]healthTarget{})
+	if count() != 1 {
+		t.Fatalf("Expected series no longer probed to be deleted, got %d", count())
+	}
+	second.updateHealthGauge(nil)
+	if count() != 0 {
+		t.Fatalf("Expected series of a stopped engine to be deleted, got %d", count())
+	}
+}
+
+func TestHealthChecksStartWithData(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer listener.Close()
+	probed := make(chan struct{}, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			probed <- struct{}{}
+		}
+	}()
+
+	// a started engine without health_check in the Corefile
+	e := newSyncEngine("")
+	e.HealthInterval = 10 * time.Millisecond
+	e.started.Store(true)
+	defer close(e.stop)
+	controller := newController(e)
+	controller.Name = "data"
+	e.Controllers = []*Controller{controller}
+
+	rrset := RRSet{ID: 1, Name: "www", Type: "A", Records: []Record{{ID: 1, TTL: 60, Data: "127.0.0.1"}}}
+	domainData := DomainData{Domain: Domain{ID: 1, Name: "example.com", Serial: "1"}, Zones: []Zone{{ID: 1, RRsets: []RRSet{rrset}}}}
+	controller.applyAllData([]DomainData{domainData})
+	if e.healthWanted.Load() {
+		t.Fatalf("Expected no health checks without checked RRsets")
+	}
+
+	// the loop starts once the data configures a check
+	domainData.Zones[0].RRsets[0].HealthCheck = &HealthCheck{Type: HealthCheckTCP, Port: listener.Addr().(*net.TCPAddr).Port}
+	controller.applyAllData([]DomainData{domainData})
+	select {
+	case <-probed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected RRset health check from data to be probed")
+	}
+}
@@ -2,28 +2,48 @@ package nexns
 
 import (
 	"context"
-	"fmt"
-	"log"
 	"net"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/fall"
+	"github.com/coredns/coredns/plugin/pkg/rcode"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
 
 type NexnsPlugin struct {
-	Next          plugin.Handler
-	ControllerURL string
-	ClientId      string
-	ClientSecret  string
-	Database      Trie
+	Next       plugin.Handler
+	Zones      []string
+	Fall       fall.F
+	NoMatch    NoMatchPolicy
+	Order      string
+	MaxAnswers int
+	NotReady   string
+
+	FailoverTTL int
+
+	roundRobin roundRobin
+	noMatchLog noMatchLog
+
+	engine *syncEngine // 与 Controller 及健康检查配置相同的其他 server block 共用
 }
 
+// 数据就绪前的查询处理方式
+const (
+	NotReadyServfail    = "servfail"
+	NotReadyFallthrough = "fallthrough"
+)
+
 type WSNotification struct {
 	Type   string `json:"type"`
 	Action string `json:"action"`
 	Domain int    `json:"domain"`
+
+	// 变更后的域名序列号与 RRset 级变更，均为空时重新拉取整个域名
+	Serial string       `json:"serial"`
+	Delta  *DomainDelta `json:"delta"`
 }
 
 func (p *NexnsPlugin) Name() string {
@@ -31,23 +51,26 @@ func (p *NexnsPlugin) Name() string {
 }
 
 func (p *NexnsPlugin) Init() error {
-	err := p.loadAllDataFromURL()
-	if err != nil {
-		return fmt.Errorf("[Nexns] Failed to initialize plugin: %v", err)
-	}
+	// sync and health checks are shared with server blocks of identical settings
+	p.engine = acquireEngine(p.engine)
 
-	// websocket to recv notifications
-	go func() error {
-		for {
-			err := p.connectToNotificationChannel()
-			if err != nil {
-				time.Sleep(5 * time.Second) // 等待一段时间后尝试重新连接
-			}
-		}
-	}()
+	return nil
+}
+
+// database returns the current database of the sync engine
+func (p *NexnsPlugin) database() *Trie {
+	return p.engine.Database()
+}
 
-	log.Println("[Nexns] Init success. Controller URL:", p.ControllerURL)
+// Ready implements the ready.Readiness interface, true once data of every controller was loaded
+// or restored from snapshot
+func (p *NexnsPlugin) Ready() bool {
+	return p.engine.Ready()
+}
 
+// Shutdown stops background work of the plugin
+func (p *NexnsPlugin) Shutdown() error {
+	p.engine.release()
 	return nil
 }
 
@@ -59,13 +82,60 @@ func (p *NexnsPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns
 	queryType := dns.TypeToString[state.QType()]
 	sourceIP := net.ParseIP(state.IP())
 
-	domainData := p.Database.Search(queryName)
+	server := metrics.WithServer(ctx)
+
+	// debug view of the local overrides, for local clients only
+	if state.QClass() == dns.ClassCHAOS && state.QType() == dns.TypeTXT && queryName == OverridesDebugName && sourceIP != nil && sourceIP.IsLoopback() {
+		return p.serveOverrides(w, r)
+	}
+
+	// only answer for names inside the server block's zones
+	zone := plugin.Zones(p.Zones).Matches(state.Name())
+	if zone == "" {
+		return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+	}
+
+	domainData := p.database().Search(queryName)
+
+	// domain unknown while some controller has no data yet, it may publish the domain
+	if domainData == nil && !p.Ready() {
+		if p.NotReady == NotReadyFallthrough {
+			fallthroughCount.WithLabelValues(server, "not_ready").Inc()
+			return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+		}
+		queryCount.WithLabelValues(server, "", "", queryType, rcode.ToString(dns.RcodeServerFailure)).Inc()
+		return dns.RcodeServerFailure, nil
+	}
 
 	// if domain not exists, pass to next plugin
 	if domainData == nil {
+		fallthroughCount.WithLabelValues(server, "unknown_domain").Inc()
 		return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
 	}
 
+	// no view matches client, apply no-match policy
+	if len(matchRules(domainData, sourceIP)) == 0 {
+		policy := p.noMatchPolicy(&domainData.Domain)
+		viewNoMatchCount.WithLabelValues(server, policy.Action).Inc()
+		p.noMatchLog.log(domainData.Domain.Name, sourceIP, policy, time.Now())
+
+		switch policy.Action {
+		case NoMatchRefused:
+			queryCount.WithLabelValues(server, domainData.Domain.Name, "", queryType, rcode.ToString(dns.RcodeRefused)).Inc()
+			return dns.RcodeRefused, nil
+		case NoMatchFallthrough:
+			fallthroughCount.WithLabelValues(server, "no_match").Inc()
+			return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+		}
+		// nxdomain, or answer from default view
+	}
+
+	// view answering the client, for metrics
+	view := ""
+	if zones := p.matchZones(domainData, sourceIP); len(zones) > 0 {
+		view = zones[0].Name
+	}
+
 	rrDataset := make([]dns.RR, 0)
 	rrExtraset := make([]dns.RR, 0)
 
@@ -76,31 +146,38 @@ func (p *NexnsPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns
 	}
 
 	// regular response
-	domain, rrset := p.searchRRsetFromDomainData(domainData, queryName, queryType, sourceIP)
-	ds, es := p.parseRRset(domain, rrset, sourceIP)
+	domain, rrsetZone, rrset := p.searchRRsetFromDomainData(domainData, queryName, queryType, sourceIP)
+	ds, es := p.parseRRset(domain, rrsetZone, rrset, sourceIP)
 	rrDataset = append(rrDataset, ds...)
 	rrExtraset = append(rrExtraset, es...)
 
 	// CNAME response, limit depth=1
 	if state.QType() != dns.TypeCNAME {
-		cnameDomain, cnameRRset := p.searchRRset(queryName, "CNAME", sourceIP)
+		cnameDomain, cnameZone, cnameRRset := p.searchRRset(queryName, "CNAME", sourceIP)
 		if cnameRRset != nil {
-			ds, _ := p.parseRRset(cnameDomain, cnameRRset, sourceIP)
+			ds, _ := p.parseRRset(cnameDomain, cnameZone, cnameRRset, sourceIP)
 
 			// Add CNAME record itself
 			rrDataset = append(rrDataset, ds...)
 
 			// Add CNAMEd records of same type
 			for _, cnameRR := range ds {
-				domain, rrset := p.searchRRset(cnameRR.(*dns.CNAME).Target, queryType, sourceIP)
-				ds, es := p.parseRRset(domain, rrset, sourceIP)
+				domain, zone, rrset := p.searchRRset(cnameRR.(*dns.CNAME).Target, queryType, sourceIP)
+				ds, es := p.parseRRset(domain, zone, rrset, sourceIP)
 				rrDataset = append(rrDataset, ds...)
 				rrExtraset = append(rrExtraset, es...)
 			}
 		}
 	}
 
+	// name not found under a known domain, let next plugin try if configured
+	if len(rrDataset) == 0 && p.Fall.Through(state.Name()) {
+		fallthroughCount.WithLabelValues(server, "no_records").Inc()
+		return plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
+	}
+
 	code, msg := p.writeAnswer(&rrDataset, &rrExtraset, r)
 	w.WriteMsg(msg)
+	queryCount.WithLabelValues(server, domainData.Domain.Name, view, queryType, rcode.ToString(code)).Inc()
 	return code, nil
 }
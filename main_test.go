@@ -0,0 +1,266 @@
+package nexns
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func buildTestingPlugin() (*NexnsPlugin, error) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		return nil, err
+	}
+	return &NexnsPlugin{
+		Zones:  []string{"."},
+		Next:   test.ErrorHandler(),
+		engine: buildTestingEngine(trie),
+	}, nil
+}
+
+// serveTestingQuery sends a query to the plugin and returns the response, which is nil if the plugin
+// didn't write one
+func serveTestingQuery(p *NexnsPlugin, name string, qtype uint16, client string) (int, *dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: client})
+	code, err := p.ServeDNS(context.TODO(), rec, r)
+	return code, rec.Msg, err
+}
+
+func TestServeDNS(t *testing.T) {
+	p, err := buildTestingPlugin()
+	if err != nil {
+		t.Fatalf("Error building test plugin: %s", err)
+	}
+
+	_, msg, err := serveTestingQuery(p, "www.example.com.", dns.TypeA, "10.0.0.1")
+	if err != nil || msg == nil || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "1.0.0.1" {
+		t.Fatalf("Expected answer 1.0.0.1, got %v %v", msg, err)
+	}
+	if !msg.Authoritative {
+		t.Fatalf("Expected authoritative answer")
+	}
+
+	_, msg, _ = serveTestingQuery(p, "missing.example.com.", dns.TypeA, "10.0.0.1")
+	if msg == nil || msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN for missing name, got %v", msg)
+	}
+
+	// domains unknown to the controller go to the next plugin
+	_, msg, _ = serveTestingQuery(p, "www.unknown.org.", dns.TypeA, "10.0.0.1")
+	if msg == nil || msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected unknown domain to reach the next plugin, got %v", msg)
+	}
+}
+
+func TestServeDNSZones(t *testing.T) {
+	p, err := buildTestingPlugin()
+	if err != nil {
+		t.Fatalf("Error building test plugin: %s", err)
+	}
+	p.Zones = []string{"example.com."}
+
+	_, msg, _ := serveTestingQuery(p, "www.example.com.", dns.TypeA, "10.0.0.1")
+	if msg == nil || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Expected answer inside zone, got %v", msg)
+	}
+
+	// test.com is served by the controller, but not in the zones of the server block
+	_, msg, _ = serveTestingQuery(p, "www.test.com.", dns.TypeA, "10.0.0.1")
+	if msg == nil || msg.Rcode != dns.RcodeServerFailure || len(msg.Answer) != 0 {
+		t.Fatalf("Expected query outside of zones to reach the next plugin, got %v", msg)
+	}
+
+	// no next plugin
+	p.Next = nil
+	code, _, err := serveTestingQuery(p, "www.test.com.", dns.TypeA, "10.0.0.1")
+	if code != dns.RcodeServerFailure || err == nil {
+		t.Fatalf("Expected SERVFAIL and error without next plugin, got %d %v", code, err)
+	}
+}
+
+func TestServeDNSFallthrough(t *testing.T) {
+	p, err := buildTestingPlugin()
+	if err != nil {
+		t.Fatalf("Error building test plugin: %s", err)
+	}
+	p.Fall.SetZonesFromArgs([]string{"example.com"})
+
+	_, msg, _ := serveTestingQuery(p, "missing.example.com.", dns.TypeA, "10.0.0.1")
+	if msg == nil || msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected empty answer in fallthrough zone to reach the next plugin, got %v", msg)
+	}
+	_, msg, _ = serveTestingQuery(p, "missing.test.com.", dns.TypeA, "10.0.0.1")
+	if msg == nil || msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN outside of fallthrough zones, got %v", msg)
+	}
+
+	// names with records are answered
+	_, msg, _ = serveTestingQuery(p, "www.example.com.", dns.TypeA, "10.0.0.1")
+	if msg == nil || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Expected answer in fallthrough zone, got %v", msg)
+	}
+}
+
+func TestServeDNSNoMatch(t *testing.T) {
+	p, err := buildTestingPlugin()
+	if err != nil {
+		t.Fatalf("Error building test plugin: %s", err)
+	}
+	internal := DomainData{
+		Domain: Domain{ID: 5, Name: "internal.com", Serial: "1"},
+		Zones: []Zone{
+			{ID: 51, Name: "office", Rules: []string{"10.0.0.0/8"}, RRsets: []RRSet{{ID: 511, Name: "www", Type: "A", Records: []Record{{ID: 1, TTL: 60, Data: "10.0.0.80"}}}}},
+			{ID: 52, Name: "public", RRsets: []RRSet{{ID: 521, Name: "www", Type: "A", Records: []Record{{ID: 2, TTL: 60, Data: "192.0.2.80"}}}}},
+		},
+	}
+	own := internal
+	own.Domain = Domain{ID: 6, Name: "own.com", Serial: "1", NoMatch: NoMatchRefused}
+	p.engine.database.Store(BuildTrie([]DomainData{internal, own}))
+
+	// matching clients are answered from their view whatever the policy
+	_, msg, _ := serveTestingQuery(p, "www.internal.com.", dns.TypeA, "10.1.1.1")
+	if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "10.0.0.80" {
+		t.Fatalf("Expected answer of matching view, got %v", msg)
+	}
+
+	tests := []struct {
+		policy NoMatchPolicy
+		name   string
+		code   int    // returned by ServeDNS
+		rcode  int    // of the written response, -1 if none
+		answer string // first answer
+	}{
+		{NoMatchPolicy{}, "www.internal.com.", dns.RcodeNameError, dns.RcodeNameError, ""},
+		{NoMatchPolicy{Action: NoMatchNXDomain}, "www.internal.com.", dns.RcodeNameError, dns.RcodeNameError, ""},
+		{NoMatchPolicy{Action: NoMatchRefused}, "www.internal.com.", dns.RcodeRefused, -1, ""},
+		{NoMatchPolicy{Action: NoMatchFallthrough}, "www.internal.com.", dns.RcodeServerFailure, dns.RcodeServerFailure, ""},
+		{NoMatchPolicy{Action: NoMatchView, View: "public"}, "www.internal.com.", dns.RcodeSuccess, dns.RcodeSuccess, "192.0.2.80"},
+		{NoMatchPolicy{Action: NoMatchView, View: "missing"}, "www.internal.com.", dns.RcodeNameError, dns.RcodeNameError, ""},
+		// the domain's own policy wins over the Corefile's
+		{NoMatchPolicy{Action: NoMatchView, View: "public"}, "www.own.com.", dns.RcodeRefused, -1, ""},
+	}
+
+	for i, test := range tests {
+		p.NoMatch = test.policy
+		code, msg, _ := serveTestingQuery(p, test.name, dns.TypeA, "8.8.8.8")
+		if code != test.code {
+			t.Fatalf("Test %d: expected code %d, got %d", i, test.code, code)
+		}
+		if test.rcode < 0 {
+			if msg != nil {
+				t.Fatalf("Test %d: expected no response written, got %v", i, msg)
+			}
+			continue
+		}
+		if msg == nil || msg.Rcode != test.rcode {
+			t.Fatalf("Test %d: expected rcode %d, got %v", i, test.rcode, msg)
+		}
+		if test.answer != "" && (len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != test.answer) {
+			t.Fatalf("Test %d: expected answer %s, got %v", i, test.answer, msg)
+		}
+	}
+
+	// default view of the domain
+	own.Domain.NoMatch = NoMatchView
+	own.Domain.DefaultView = "public"
+	p.engine.database.Store(BuildTrie([]DomainData{own}))
+	p.NoMatch = NoMatchPolicy{Action: NoMatchRefused}
+	_, msg, _ = serveTestingQuery(p, "www.own.com.", dns.TypeA, "8.8.8.8")
+	if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "192.0.2.80" {
+		t.Fatalf("Expected answer of the domain's default view, got %v", msg)
+	}
+}
+
+func TestServeDNSNotReady(t *testing.T) {
+	p, err := buildTestingPlugin()
+	if err != nil {
+		t.Fatalf("Error building test plugin: %s", err)
+	}
+	snapshot := filepath.Join(t.TempDir(), "nexns.snapshot")
+	p.engine.SnapshotPath = snapshot
+	buildTestingController(p.engine, "http://127.0.0.1:1/")
+	if err := p.engine.saveSnapshot(); err != nil {
+		t.Fatalf("Error saving snapshot: %s", err)
+	}
+
+	e := newSyncEngine(snapshot)
+	controller := newController(e)
+	controller.URLs = []string{"http://127.0.0.1:1/"}
+	e.Controllers = []*Controller{controller}
+	p.engine = e
+
+	// SERVFAIL is returned for the server to write
+	code, msg, _ := serveTestingQuery(p, "www.example.com.", dns.TypeA, "10.0.0.1")
+	if p.Ready() || code != dns.RcodeServerFailure || msg != nil {
+		t.Fatalf("Expected SERVFAIL before data is loaded, got %d %v", code, msg)
+	}
+
+	p.NotReady = NotReadyFallthrough
+	_, msg, _ = serveTestingQuery(p, "www.example.com.", dns.TypeA, "10.0.0.1")
+	if msg == nil || msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected query to reach the next plugin before data is loaded, got %v", msg)
+	}
+
+	// restored from snapshot
+	if err := e.loadSnapshot(); err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	_, msg, _ = serveTestingQuery(p, "www.example.com.", dns.TypeA, "10.0.0.1")
+	if !p.Ready() || msg == nil || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Expected answer once restored from snapshot, got %v", msg)
+	}
+
+	// loaded from the controller
+	p.NotReady = NotReadyServfail
+	controller.ready.Store(false)
+	code, _, _ = serveTestingQuery(p, "www.unknown.org.", dns.TypeA, "10.0.0.1")
+	if code != dns.RcodeServerFailure {
+		t.Fatalf("Expected SERVFAIL for unknown domain while a controller is not ready, got %d", code)
+	}
+	controller.applyAllData(e.dumpDatabase())
+	_, msg, _ = serveTestingQuery(p, "www.example.com.", dns.TypeA, "10.0.0.1")
+	if !p.Ready() || msg == nil || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Expected answer once the controller loaded its data, got %v", msg)
+	}
+}
+
+func TestServeDNSDeadController(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+	e := newSyncEngine("")
+	live := newController(e)
+	live.Name = "live"
+	dead := newController(e)
+	dead.Name = "dead"
+	dead.URLs = []string{"http://127.0.0.1:1/"}
+	e.Controllers = []*Controller{live, dead}
+	live.applyAllData(buildTestingEngine(trie).dumpDatabase())
+	p := &NexnsPlugin{Zones: []string{"."}, Next: test.ErrorHandler(), engine: e}
+
+	// domains of the live controller are answered, the readiness check waits for both
+	if p.Ready() {
+		t.Fatalf("Expected plugin not to be ready while a controller has no data")
+	}
+	_, msg, _ := serveTestingQuery(p, "www.example.com.", dns.TypeA, "10.0.0.1")
+	if msg == nil || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Expected answer from the live controller, got %v", msg)
+	}
+	_, msg, _ = serveTestingQuery(p, "missing.example.com.", dns.TypeA, "10.0.0.1")
+	if msg == nil || msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN in a loaded domain, got %v", msg)
+	}
+
+	// the dead controller may publish unknown domains
+	code, msg, _ := serveTestingQuery(p, "www.unknown.org.", dns.TypeA, "10.0.0.1")
+	if code != dns.RcodeServerFailure || msg != nil {
+		t.Fatalf("Expected SERVFAIL for unknown domain, got %d %v", code, msg)
+	}
+}
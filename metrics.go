@@ -0,0 +1,142 @@
+package nexns
+
+import (
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// queryCount counts answered queries by domain, view, qtype and rcode
+	queryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "queries_total",
+		Help:      "Counter of queries answered by nexns.",
+	}, []string{"server", "domain", "view", "type", "rcode"})
+
+	// fallthroughCount counts queries passed to the next plugin, by reason
+	fallthroughCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "fallthrough_total",
+		Help:      "Counter of queries passed to the next plugin.",
+	}, []string{"server", "reason"})
+
+	// viewNoMatchCount counts queries for which no view matched the client, by action taken
+	viewNoMatchCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "view_nomatch_total",
+		Help:      "Counter of queries for which no view matched the client.",
+	}, []string{"server", "action"})
+
+	// 以下同步与健康检查指标属于 syncEngine，而一个 syncEngine 由设置相同的多个 server block 共用，
+	// 数据只同步、地址只探测一次，无法归属于某个 server，因此没有 server 标签，以 controller 区分
+
+	// healthCheckCount counts health check probes by type and result
+	healthCheckCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "health_checks_total",
+		Help:      "Counter of health check probes.",
+	}, []string{"type", "result"})
+
+	// healthStatusGauge is 1 if the address of a record passed its last health check, else 0
+	healthStatusGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "health_status",
+		Help:      "Health status of record addresses, 1 for healthy and 0 for unhealthy.",
+	}, []string{"name", "address", "type"})
+
+	// notifyConnectedGauge is 1 while the notification channel is connected
+	notifyConnectedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "notification_connected",
+		Help:      "Whether the notification channel is connected, 1 for up and 0 for down.",
+	}, []string{"controller"})
+
+	// notifyLastMessageGauge is the time of the last message or pong on the notification channel
+	notifyLastMessageGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "notification_last_message_timestamp_seconds",
+		Help:      "Unix time of the last message or pong received on the notification channel.",
+	}, []string{"controller"})
+
+	// syncCount counts loads from the controller by kind (full, partial, delta, reconcile, poll) and result
+	syncCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "sync_total",
+		Help:      "Counter of data loads from the controller.",
+	}, []string{"controller", "kind", "result"})
+
+	// lastSyncGauge is the time of the last successful load from the controller
+	lastSyncGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "last_sync_timestamp_seconds",
+		Help:      "Unix time of the last successful data load from the controller.",
+	}, []string{"controller"})
+
+	// notificationCount counts notifications received from the controller
+	notificationCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "notifications_total",
+		Help:      "Counter of notifications received from the controller.",
+	}, []string{"controller"})
+
+	// endpointActiveGauge is 1 for the controller endpoint in use, else 0
+	endpointActiveGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "controller_active",
+		Help:      "Whether the controller endpoint is in use, 1 for active and 0 for standby.",
+	}, []string{"controller", "endpoint"})
+
+	// domainsGauge is the number of loaded domains, by the controller publishing them
+	domainsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "domains",
+		Help:      "Number of domains loaded.",
+	}, []string{"controller"})
+
+	// recordsGauge is the number of loaded records
+	recordsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "nexns",
+		Name:      "records",
+		Help:      "Number of records loaded, over all views.",
+	}, []string{"controller"})
+)
+
+// countSync records the result of a load from the controller
+func (c *Controller) countSync(kind string, err error) {
+	controller := c.name()
+	if err != nil {
+		syncCount.WithLabelValues(controller, kind, "failure").Inc()
+		return
+	}
+	syncCount.WithLabelValues(controller, kind, "success").Inc()
+	lastSyncGauge.WithLabelValues(controller).Set(float64(time.Now().Unix()))
+
+	records := 0
+	c.engine.updateLock.Lock()
+	domains := len(c.domains)
+	for _, domainData := range c.domains {
+		for _, zone := range domainData.Zones {
+			for _, rrset := range zone.RRsets {
+				records += len(rrset.Records)
+			}
+		}
+	}
+	c.engine.updateLock.Unlock()
+	domainsGauge.WithLabelValues(controller).Set(float64(domains))
+	recordsGauge.WithLabelValues(controller).Set(float64(records))
+}
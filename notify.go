@@ -0,0 +1,70 @@
+package nexns
+
+import (
+	"errors"
+)
+
+// 变更通知的传输方式
+const (
+	NotifyWebSocket = "websocket" // api/v1/ws/client-notify/
+	NotifySSE       = "sse"       // api/v1/sse/client-notify/，Server-Sent Events
+	NotifyGRPC      = "grpc"      // nexns.v1.Notification/Subscribe 双向流，逐条确认
+)
+
+// NotifyAck 是插件处理一条变更通知后回复给 Controller 的确认
+type NotifyAck struct {
+	Domain  int    `json:"domain"`
+	Serial  string `json:"serial"` // 处理后本地的域名序列号
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// errNotifyRejected means the controller refused the notification channel, e.g. for bad credentials
+var errNotifyRejected = errors.New("rejected by server")
+
+// notifySource is a connection receiving change notifications from a controller endpoint
+type notifySource interface {
+	// connect opens the channel to a controller endpoint.
+	// Returns whether the endpoint itself failed, so another one should be tried.
+	connect(endpoint string) (endpointFailed bool, err error)
+
+	// receive blocks until the next notification arrives or the channel fails
+	receive() (*WSNotification, error)
+
+	// ack reports whether a notification was applied, if the transport supports acknowledgements
+	ack(notification *WSNotification, applyErr error) error
+
+	// ping keeps the channel alive, it's called periodically from another goroutine
+	ping() error
+
+	// close closes the channel and unblocks receive, it may be called more than once
+	close()
+}
+
+// newNotifySource returns an unconnected notification source of the configured transport
+func (c *Controller) newNotifySource() notifySource {
+	switch c.NotifyTransport {
+	case NotifySSE:
+		return &sseSource{controller: c}
+	case NotifyGRPC:
+		return &grpcSource{controller: c, address: c.NotifyAddress}
+	default:
+		return &wsSource{controller: c}
+	}
+}
+
+// ackFor returns the acknowledgement of a notification, with the serial the domain is at now
+func (c *Controller) ackFor(notification *WSNotification, applyErr error) *NotifyAck {
+	ack := &NotifyAck{Domain: notification.Domain, Applied: applyErr == nil}
+	if applyErr != nil {
+		ack.Error = applyErr.Error()
+	}
+
+	c.engine.updateLock.Lock()
+	if domainData := c.domainByID(notification.Domain); domainData != nil {
+		ack.Serial = domainData.Domain.Serial
+	}
+	c.engine.updateLock.Unlock()
+
+	return ack
+}
@@ -0,0 +1,146 @@
+package nexns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// testingDelta changes www.example.com of the testing trie to 9.9.9.9
+const testingDelta = `{"domain": 1, "serial": "123456790", "delta": {"domain": 1, "from_serial": "123456789", "serial": "123456790",
+	"changes": [{"zone": 11, "action": "upsert", "rrset": {"id": 111, "name": "www", "type": "A", "records": [{"id": 1, "ttl": 60, "val": "9.9.9.9"}]}}]}}`
+
+// waitForSerial waits until example.com is served at a serial
+func waitForSerial(e *syncEngine, serial string) bool {
+	for i := 0; i < 100; i++ {
+		if domainData := e.Database().Search("example.com."); domainData != nil && domainData.Domain.Serial == serial {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestSSENotifications(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/sse/client-notify/" || r.Header.Get("X-CLIENT-ID") != "id" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, ": keepalive\n\nevent: ping\ndata: {}\n\ndata: %s\n\n", strings.ReplaceAll(testingDelta, "\n", ""))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	e := buildTestingEngine(trie)
+	controller := buildTestingController(e, server.URL+"/")
+	controller.ClientId = "id"
+	controller.NotifyTransport = NotifySSE
+	controller.ready.Store(false)
+
+	stop := make(chan struct{})
+	go controller.connectToNotificationChannel(stop)
+	defer close(stop)
+
+	if !waitForSerial(e, "123456790") {
+		t.Fatalf("Expected delta from event stream to be applied")
+	}
+
+	// rejected credentials are not retried quickly
+	controller.ClientId = "other"
+	_, err = controller.newNotifySource().connect(server.URL + "/")
+	if err == nil || !errors.Is(err, errNotifyRejected) {
+		t.Fatalf("Expected rejected error, got %v", err)
+	}
+}
+
+func TestWebSocketRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	controller := newController(newSyncEngine(""))
+	controller.URLs = []string{server.URL + "/"}
+
+	// rejected credentials are not retried quickly, as with the other transports
+	_, err := controller.newNotifySource().connect(server.URL + "/")
+	if err == nil || !errors.Is(err, errNotifyRejected) {
+		t.Fatalf("Expected rejected error, got %v", err)
+	}
+}
+
+func TestGRPCNotifications(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+
+	acks := make(chan NotifyAck, 1)
+	server := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		if method != notifyGRPCMethod || len(md.Get("x-client-id")) == 0 || md.Get("x-client-id")[0] != "id" {
+			return fmt.Errorf("unexpected call %s", method)
+		}
+
+		notification := WSNotification{}
+		jsonCodec{}.Unmarshal([]byte(testingDelta), &notification)
+		err := stream.SendMsg(&notification)
+		if err != nil {
+			return err
+		}
+
+		ack := NotifyAck{}
+		err = stream.RecvMsg(&ack)
+		if err != nil {
+			return err
+		}
+		acks <- ack
+		<-stream.Context().Done()
+		return nil
+	}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	e := buildTestingEngine(trie)
+	controller := buildTestingController(e, "http://"+listener.Addr().String()+"/")
+	controller.ClientId = "id"
+	controller.NotifyTransport = NotifyGRPC
+	controller.ready.Store(false)
+
+	stop := make(chan struct{})
+	go controller.connectToNotificationChannel(stop)
+	defer close(stop)
+
+	select {
+	case ack := <-acks:
+		if ack.Domain != 1 || !ack.Applied || ack.Serial != "123456790" {
+			t.Fatalf("Unexpected acknowledgement %+v", ack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected notification to be acknowledged")
+	}
+	if domainData := e.Database().Search("www.example.com."); domainData.Domain.Serial != "123456790" {
+		t.Fatalf("Expected delta from stream to be applied")
+	}
+}
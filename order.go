@@ -0,0 +1,111 @@
+package nexns
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// RRset 内记录的排序方式
+const (
+	OrderFixed      = "fixed"
+	OrderRandom     = "random"
+	OrderRoundRobin = "round_robin"
+	OrderWeighted   = "weighted"
+)
+
+// roundRobin keeps a rotation counter per RRset
+type roundRobin struct {
+	counters sync.Map // rrsetKey -> *uint32
+}
+
+func (rr *roundRobin) next(key rrsetKey) uint32 {
+	counter, _ := rr.counters.LoadOrStore(key, new(uint32))
+	return atomic.AddUint32(counter.(*uint32), 1) - 1
+}
+
+func checkOrder(order string) error {
+	switch order {
+	case OrderFixed, OrderRandom, OrderRoundRobin, OrderWeighted:
+		return nil
+	}
+	return fmt.Errorf("unknown order: %s", order)
+}
+
+// orderRecords returns the available records of rrset in answer order, capped to max answers
+func (p *NexnsPlugin) orderRecords(domain *Domain, zone *Zone, rrset *RRSet) []Record {
+	order := rrset.Order
+	if checkOrder(order) != nil {
+		order = p.Order
+	}
+	maxAnswers := rrset.MaxAnswers
+	if maxAnswers <= 0 {
+		maxAnswers = p.MaxAnswers
+	}
+
+	records, failedOver := p.engine.poolRecords(domain, zone, rrset)
+
+	if len(records) > 1 {
+		switch order {
+		case OrderRandom:
+			rand.Shuffle(len(records), func(i, j int) {
+				records[i], records[j] = records[j], records[i]
+			})
+
+		case OrderRoundRobin:
+			shift := int(p.roundRobin.next(newRRsetKey(domain, zone, rrset)) % uint32(len(records)))
+			records = append(records[shift:], records[:shift]...)
+
+		case OrderWeighted:
+			shuffleWeighted(records)
+		}
+	}
+
+	if maxAnswers > 0 && len(records) > maxAnswers {
+		records = records[:maxAnswers]
+	}
+
+	// answer with a low TTL while failed over, so clients come back to the primary pool soon
+	if failedOver {
+		ttl := p.failoverTTL(rrset)
+		for i := range records {
+			if ttl > 0 && records[i].TTL > ttl {
+				records[i].TTL = ttl
+			}
+		}
+	}
+
+	return records
+}
+
+// shuffleWeighted orders records by weighted random sampling without replacement
+// (Efraimidis-Spirakis), so a record with twice the weight is twice as likely to come first.
+// Records without a weight count as weight 1.
+func shuffleWeighted(records []Record) {
+	keys := make([]float64, len(records))
+	for i, record := range records {
+		weight := float64(record.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		keys[i] = math.Pow(rand.Float64(), 1/weight)
+	}
+
+	sort.Sort(byKey{records, keys})
+}
+
+// byKey sorts records by descending key
+type byKey struct {
+	records []Record
+	keys    []float64
+}
+
+func (b byKey) Len() int           { return len(b.records) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] > b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.records[i], b.records[j] = b.records[j], b.records[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
@@ -0,0 +1,101 @@
+package nexns
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func buildTestingRRset(order string, maxAnswers int) (*RRSet, error) {
+	rrsetJsonData := `{
+		"id": 111, "name": "www", "type": "A",
+		"records": [
+			{"id": 1, "ttl": 3600, "val": "1.0.0.1", "weight": 1},
+			{"id": 2, "ttl": 3600, "val": "1.0.0.2", "weight": 1},
+			{"id": 3, "ttl": 3600, "val": "1.0.0.3", "weight": 98}
+		]
+	}`
+	rrset := &RRSet{}
+	err := json.Unmarshal([]byte(rrsetJsonData), rrset)
+	rrset.Order = order
+	rrset.MaxAnswers = maxAnswers
+	return rrset, err
+}
+
+func TestOrderFixed(t *testing.T) {
+	p := &NexnsPlugin{Order: OrderFixed, engine: newSyncEngine("")}
+	rrset, err := buildTestingRRset("", 0)
+	if err != nil {
+		t.Fatalf("Error building test rrset: %s", err)
+	}
+
+	records := p.orderRecords(&Domain{Name: "example.com"}, &Zone{Name: "default"}, rrset)
+	for i, record := range records {
+		if record.ID != i+1 {
+			t.Fatalf("Fixed order changed record %d to id %d", i, record.ID)
+		}
+	}
+}
+
+func TestOrderRoundRobin(t *testing.T) {
+	p := &NexnsPlugin{Order: OrderFixed, engine: newSyncEngine("")}
+	rrset, err := buildTestingRRset(OrderRoundRobin, 0)
+	if err != nil {
+		t.Fatalf("Error building test rrset: %s", err)
+	}
+
+	for i := 0; i < 6; i++ {
+		records := p.orderRecords(&Domain{Name: "example.com"}, &Zone{Name: "default"}, rrset)
+		if records[0].ID != i%3+1 {
+			t.Fatalf("Round %d: expected first record id %d, got %d", i, i%3+1, records[0].ID)
+		}
+		if len(records) != 3 {
+			t.Fatalf("Round %d: expected 3 records, got %d", i, len(records))
+		}
+	}
+}
+
+func TestOrderWeighted(t *testing.T) {
+	p := &NexnsPlugin{Order: OrderFixed, engine: newSyncEngine("")}
+	rrset, err := buildTestingRRset(OrderWeighted, 1)
+	if err != nil {
+		t.Fatalf("Error building test rrset: %s", err)
+	}
+
+	heavy := 0
+	for i := 0; i < 1000; i++ {
+		records := p.orderRecords(&Domain{Name: "example.com"}, &Zone{Name: "default"}, rrset)
+		if len(records) != 1 {
+			t.Fatalf("Expected max_answers to cap answer to 1 record, got %d", len(records))
+		}
+		if records[0].ID == 3 {
+			heavy++
+		}
+	}
+
+	// weight 98 of 100, should come first nearly always
+	if heavy < 900 {
+		t.Fatalf("Heavy record came first %d/1000 times", heavy)
+	}
+}
+
+func TestOrderRoundRobinSameID(t *testing.T) {
+	p := &NexnsPlugin{Order: OrderRoundRobin, engine: newSyncEngine("")}
+	rrset, err := buildTestingRRset("", 0)
+	if err != nil {
+		t.Fatalf("Error building test rrset: %s", err)
+	}
+
+	// RRsets of zone files or of different controllers may share an id
+	example := &Domain{Name: "example.com"}
+	test := &Domain{Name: "test.com"}
+	p.orderRecords(example, &Zone{Name: "default"}, rrset)
+	if records := p.orderRecords(test, &Zone{Name: "default"}, rrset); records[0].ID != 1 {
+		t.Fatalf("Expected rotation of another domain to start over, got first record id %d", records[0].ID)
+	}
+	if records := p.orderRecords(example, &Zone{Name: "internal"}, rrset); records[0].ID != 1 {
+		t.Fatalf("Expected rotation of another view to start over, got first record id %d", records[0].ID)
+	}
+	if records := p.orderRecords(example, &Zone{Name: "default"}, rrset); records[0].ID != 2 {
+		t.Fatalf("Expected rotation to go on, got first record id %d", records[0].ID)
+	}
+}
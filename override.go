@@ -0,0 +1,246 @@
+package nexns
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// 本地覆盖的操作
+const (
+	OverrideAdd     = "add"     // 向 RRset 追加记录，RRset 不存在时新建
+	OverrideReplace = "replace" // 替换 RRset 的全部记录，RRset 不存在时新建
+	OverrideHide    = "hide"    // 隐藏 RRset，匹配该视图的客户端查询时如同没有记录
+)
+
+// OverridesDebugName 是查询当前本地覆盖的名称，仅应答本机发出的 CHAOS 类 TXT 查询
+const OverridesDebugName = "overrides.nexns."
+
+// Override 是叠加在 Controller 数据之上的一条本地覆盖，Controller 更新数据后仍然生效
+type Override struct {
+	Domain  string   `json:"domain"`
+	View    string   `json:"view"` // 为空时作用于域名的所有视图
+	Name    string   `json:"name"` // 相对于域名的名称，"" 或 "@" 为域名本身
+	Type    string   `json:"type"`
+	Action  string   `json:"action"`
+	Records []Record `json:"records"`
+	Comment string   `json:"comment"`
+}
+
+// loadOverrides reads and checks the overrides file
+func loadOverrides(path string) ([]Override, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := make([]Override, 0)
+	err = json.Unmarshal(content, &overrides)
+	if err != nil {
+		return nil, fmt.Errorf("%s: JSON parsing error: %v", path, err)
+	}
+
+	for i := range overrides {
+		override := &overrides[i]
+		override.Domain = strings.ToLower(strings.TrimSuffix(override.Domain, "."))
+		override.Name = strings.ToLower(override.Name)
+		if override.Name == "@" {
+			override.Name = ""
+		}
+		override.Type = strings.ToUpper(override.Type)
+
+		if override.Domain == "" {
+			return nil, fmt.Errorf("%s: override %d has no domain", path, i+1)
+		}
+		if _, exists := dns.StringToType[override.Type]; !exists {
+			return nil, fmt.Errorf("%s: override %d has unknown type %q", path, i+1, override.Type)
+		}
+		switch override.Action {
+		case OverrideAdd, OverrideReplace:
+			if len(override.Records) == 0 {
+				return nil, fmt.Errorf("%s: override %d has no records to %s", path, i+1, override.Action)
+			}
+		case OverrideHide:
+		default:
+			return nil, fmt.Errorf("%s: override %d has unknown action %q", path, i+1, override.Action)
+		}
+
+		// record ids of overrides don't collide with the controller's
+		for j := range override.Records {
+			if override.Records[j].ID == 0 {
+				override.Records[j].ID = localID(override.Domain, override.View, override.Name, override.Type, fmt.Sprint(i, j))
+			}
+		}
+	}
+
+	return overrides, nil
+}
+
+// String describes an override in logs and the debug view
+func (o *Override) String() string {
+	view := o.View
+	if view == "" {
+		view = "*"
+	}
+	name := o.Name
+	if name == "" {
+		name = "@"
+	}
+	records := make([]string, 0, len(o.Records))
+	for _, record := range o.Records {
+		records = append(records, record.Data)
+	}
+
+	description := fmt.Sprintf("%s view %s %s %s %s", o.Domain, view, name, o.Type, o.Action)
+	if len(records) > 0 {
+		description += " " + strings.Join(records, ", ")
+	}
+	if o.Comment != "" {
+		description += " (" + o.Comment + ")"
+	}
+	return description
+}
+
+// applyOverrides returns a copy of the domain with the local overrides applied, or the domain itself if no
+// override applies. The copy remembers the data it was made from. With updateLock held.
+func (e *syncEngine) applyOverrides(domainData *DomainData) *DomainData {
+	var overridden *DomainData
+
+	for i := range e.overrides {
+		override := &e.overrides[i]
+		if override.Domain != domainData.Domain.Name {
+			continue
+		}
+		if overridden == nil {
+			overridden = copyDomainData(domainData)
+			overridden.original = domainData
+		}
+
+		for j := range overridden.Zones {
+			zone := &overridden.Zones[j]
+			if override.View != "" && override.View != zone.Name {
+				continue
+			}
+			zone.applyOverride(override)
+		}
+	}
+
+	if overridden == nil {
+		return domainData
+	}
+	return overridden
+}
+
+// applyOverride applies an override to a view, whose RRset list must be a copy
+func (z *Zone) applyOverride(override *Override) {
+	index := -1
+	for i, rrset := range z.RRsets {
+		if rrset.Name == override.Name && rrset.Type == override.Type {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		z.RRsets = append(z.RRsets, RRSet{
+			ID:   localID(override.Domain, z.Name, override.Name, override.Type),
+			Name: override.Name,
+			Type: override.Type,
+		})
+		index = len(z.RRsets) - 1
+	}
+
+	rrset := &z.RRsets[index]
+	switch override.Action {
+	case OverrideAdd:
+		rrset.Records = append(append([]Record(nil), rrset.Records...), override.Records...)
+	case OverrideReplace:
+		rrset.Records = override.Records
+	case OverrideHide:
+		// an empty RRset answers no records, instead of falling through to other views
+		rrset.Records = []Record{}
+	}
+}
+
+// reloadOverrides replaces the overrides with those of the overrides file and merges the affected domains.
+// The current overrides are kept if the file can't be loaded.
+func (e *syncEngine) reloadOverrides() error {
+	overrides, err := loadOverrides(e.OverridesPath)
+	if err != nil {
+		return err
+	}
+
+	e.updateLock.Lock()
+	names := make([]string, 0, len(e.overrides)+len(overrides))
+	for _, override := range e.overrides {
+		names = append(names, override.Domain)
+	}
+	for _, override := range overrides {
+		names = append(names, override.Domain)
+	}
+	e.overrides = overrides
+	e.mergeDomains(names)
+	e.updateLock.Unlock()
+
+	log.Infof("Loaded %d local overrides from %s.", len(overrides), e.OverridesPath)
+	for _, line := range e.overridesStatus() {
+		log.Info(line)
+	}
+
+	return nil
+}
+
+// runOverrides keeps the overrides in sync with the overrides file until stop is closed
+func (e *syncEngine) runOverrides() {
+	watchFiles(e.stop, DefaultFileInterval, e.OverridesPath, func() string {
+		return filesState([]string{e.OverridesPath})
+	}, func(int) error {
+		err := e.reloadOverrides()
+		if err != nil {
+			log.Errorf("Failed to load overrides, keeping current ones: %v", err)
+		}
+		return err
+	})
+}
+
+// overridesStatus describes each override and whether it's active, that is its domain and view are served
+func (e *syncEngine) overridesStatus() []string {
+	e.updateLock.Lock()
+	overrides := e.overrides
+	e.updateLock.Unlock()
+
+	database := e.Database()
+	status := make([]string, 0, len(overrides))
+	for i := range overrides {
+		override := &overrides[i]
+
+		state := "inactive"
+		domainData := database.Search(override.Domain + ".")
+		if domainData != nil && domainData.Domain.Name == override.Domain {
+			for _, zone := range domainData.Zones {
+				if override.View == "" || override.View == zone.Name {
+					state = "active"
+					break
+				}
+			}
+		}
+		status = append(status, fmt.Sprintf("%s: %s", state, override))
+	}
+	return status
+}
+
+// serveOverrides answers the debug query for the local overrides, one TXT record per override
+func (p *NexnsPlugin) serveOverrides(w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	for _, line := range p.engine.overridesStatus() {
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: OverridesDebugName, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: splitIntoChunks(line, MaxTxtRecordSize),
+		})
+	}
+	w.WriteMsg(msg)
+	return dns.RcodeSuccess, nil
+}
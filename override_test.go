@@ -0,0 +1,110 @@
+package nexns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOverrides(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	err = os.WriteFile(path, []byte(`[
+		{"domain": "example.com", "name": "www", "type": "A", "action": "replace", "records": [{"ttl": 60, "val": "10.0.0.1"}], "comment": "maintenance"},
+		{"domain": "example.com.", "name": "ftp", "type": "A", "action": "add", "records": [{"ttl": 60, "val": "10.0.0.2"}]},
+		{"domain": "example.com", "name": "sub.www", "type": "A", "action": "hide"},
+		{"domain": "test.com", "name": "@", "type": "TXT", "action": "add", "records": [{"ttl": 60, "val": "local"}]},
+		{"domain": "missing.com", "type": "A", "action": "hide"},
+		{"domain": "test.com", "view": "office", "name": "www", "type": "A", "action": "hide"}
+	]`), 0644)
+	if err != nil {
+		t.Fatalf("Error writing overrides: %s", err)
+	}
+
+	e := buildTestingEngine(trie)
+	e.OverridesPath = path
+	controller := buildTestingController(e)
+	original := e.dumpDatabase()
+	err = e.reloadOverrides()
+	if err != nil {
+		t.Fatalf("Error loading overrides: %s", err)
+	}
+	p := &NexnsPlugin{engine: e}
+
+	lookup := func(name string, qtype string) *RRSet {
+		_, _, rrset := p.searchRRset(name, qtype, net.ParseIP("8.8.8.8"))
+		return rrset
+	}
+	check := func() {
+		if rrset := lookup("www.example.com.", "A"); rrset == nil || len(rrset.Records) != 1 || rrset.Records[0].Data != "10.0.0.1" {
+			t.Fatalf("Expected replaced records, got %+v", rrset)
+		}
+		if rrset := lookup("ftp.example.com.", "A"); rrset == nil || len(rrset.Records) != 2 || rrset.Records[1].Data != "10.0.0.2" {
+			t.Fatalf("Expected added record, got %+v", rrset)
+		}
+		if rrset := lookup("sub.www.example.com.", "A"); rrset != nil {
+			t.Fatalf("Expected hidden RRset, got %+v", rrset)
+		}
+		if rrset := lookup("test.com.", "TXT"); rrset == nil || rrset.Records[0].Data != "local" || rrset.ID >= 0 {
+			t.Fatalf("Expected new RRset at apex, got %+v", rrset)
+		}
+		if rrset := lookup("www.test.com.", "A"); rrset == nil || len(rrset.Records) != 1 {
+			t.Fatalf("Expected override of other view not to apply, got %+v", rrset)
+		}
+	}
+	check()
+
+	// the data of the controller is kept as is
+	dumped := e.dumpDatabase()
+	if len(dumped) != len(original) {
+		t.Fatalf("Expected %d domains in dump, got %d", len(original), len(dumped))
+	}
+	for _, domainData := range dumped {
+		if domainData.Domain.Name == "example.com" && domainData.Zones[0].RRsets[0].Records[0].Data != "1.0.0.1" {
+			t.Fatalf("Expected dump without overrides, got %+v", domainData.Zones[0].RRsets[0])
+		}
+	}
+
+	// overrides survive controller updates
+	controller.applyAllData(original)
+	check()
+
+	status := strings.Join(e.overridesStatus(), "\n")
+	if !strings.Contains(status, "active: example.com view * www A replace 10.0.0.1 (maintenance)") ||
+		!strings.Contains(status, "inactive: missing.com view * @ A hide") ||
+		!strings.Contains(status, "inactive: test.com view office www A hide") {
+		t.Fatalf("Unexpected overrides status:\n%s", status)
+	}
+
+	// a broken file keeps the current overrides
+	err = os.WriteFile(path, []byte(`[{"domain": "example.com", "type": "A", "action": "drop"}]`), 0644)
+	if err != nil {
+		t.Fatalf("Error writing overrides: %s", err)
+	}
+	if err := e.reloadOverrides(); err == nil {
+		t.Fatalf("Expected unknown action to be refused")
+	}
+	check()
+
+	// removing overrides restores the controller data
+	err = os.WriteFile(path, []byte(`[]`), 0644)
+	if err != nil {
+		t.Fatalf("Error writing overrides: %s", err)
+	}
+	err = e.reloadOverrides()
+	if err != nil {
+		t.Fatalf("Error loading overrides: %s", err)
+	}
+	if rrset := lookup("www.example.com.", "A"); rrset == nil || rrset.Records[0].Data != "1.0.0.1" {
+		t.Fatalf("Expected controller records after removing overrides, got %+v", rrset)
+	}
+	if domainData := e.Database().Search("example.com."); domainData.original != nil {
+		t.Fatalf("Expected domain without overrides not to keep a copy")
+	}
+}
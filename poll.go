@@ -0,0 +1,87 @@
+package nexns
+
+import (
+	"net/http"
+	"time"
+)
+
+// 数据同步方式
+const (
+	SyncPush = "push" // WebSocket 通知
+	SyncPoll = "poll" // 定时条件请求 dump 接口
+)
+
+// pollValidators remembers the validators of the last applied dump for conditional GETs
+type pollValidators struct {
+	endpoint     string
+	etag         string
+	lastModified string
+}
+
+// pollAllDataFromURL pulls all data only if it changed since the last poll.
+// Returns whether new data was applied.
+func (c *Controller) pollAllDataFromURL() (changed bool, err error) {
+	defer func() { c.countSync("poll", err) }()
+
+	controllerURL := c.controllerURL()
+	endpoint := controllerURL + "api/v1/domain/dump/"
+	req, err := c.newRequestWithCredentials(endpoint)
+	if err != nil {
+		return false, endpointError(endpoint, "request failed: %v", err)
+	}
+	// validators are only meaningful to the endpoint which sent them
+	if c.validators.endpoint == controllerURL {
+		if c.validators.etag != "" {
+			req.Header.Set("If-None-Match", c.validators.etag)
+		}
+		if c.validators.lastModified != "" {
+			req.Header.Set("If-Modified-Since", c.validators.lastModified)
+		}
+	}
+
+	response, err := c.doRequest(req)
+	if err != nil {
+		return false, endpointError(endpoint, "request failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+
+	merge := c.newDumpMerge()
+	err = c.readDump(endpoint, response, merge.add)
+	if err != nil {
+		return false, err
+	}
+
+	merge.finish()
+	c.validators = pollValidators{
+		endpoint:     controllerURL,
+		etag:         response.Header.Get("ETag"),
+		lastModified: response.Header.Get("Last-Modified"),
+	}
+
+	return true, nil
+}
+
+// runPoll polls the controller every PollInterval until stop is closed
+func (c *Controller) runPoll(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		changed, err := c.pollAllDataFromURL()
+		if err != nil {
+			log.Warningf("Failed to poll data from server: %v", err)
+		} else if changed {
+			log.Info("Successfully pulled changed data from server.")
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package nexns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPollConditionalGet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`[{"domain": {"id": 1, "domain": "example.com", "serial": "1"}, "zones": []}]`))
+	}))
+	defer server.Close()
+
+	e := newSyncEngine("")
+	controller := newController(e)
+	controller.URLs = []string{server.URL + "/"}
+	e.Controllers = []*Controller{controller}
+
+	changed, err := controller.pollAllDataFromURL()
+	if err != nil || !changed {
+		t.Fatalf("Expected first poll to apply data, changed: %v, err: %v", changed, err)
+	}
+	if e.Database().Search("example.com.") == nil || !e.Ready() {
+		t.Fatalf("Expected example.com to be loaded")
+	}
+
+	changed, err = controller.pollAllDataFromURL()
+	if err != nil || changed {
+		t.Fatalf("Expected unchanged data not to be applied, changed: %v, err: %v", changed, err)
+	}
+}
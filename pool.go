@@ -0,0 +1,170 @@
+package nexns
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultFailoverTTL = 30
+const DefaultFailbackDelay = 60 * time.Second
+
+// rrsetKey 标识一个 RRset，用于保存其轮询与记录池状态。合并多个 Controller 或区域文件的数据后 ID 不再唯一
+type rrsetKey struct {
+	domain string
+	view   string
+	name   string
+	rtype  string
+}
+
+func newRRsetKey(domain *Domain, zone *Zone, rrset *RRSet) rrsetKey {
+	return rrsetKey{domain: domain.Name, view: zone.Name, name: rrset.Name, rtype: rrset.Type}
+}
+
+// poolState tracks which record pool of an RRset is serving
+type poolState struct {
+	mu        sync.Mutex
+	active    int
+	preferred int       // higher priority pool waiting to be switched back to
+	since     time.Time // since when preferred has been available
+}
+
+func newPoolState(active int) *poolState {
+	return &poolState{active: active, preferred: active}
+}
+
+// update switches to a lower priority pool at once, but back to a higher priority pool
+// only after it has been available for delay, so a flapping pool is not served
+func (s *poolState) update(best int, now time.Time, delay time.Duration) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.active
+	if best >= s.active {
+		s.active = best
+		s.preferred = best
+		return old, old != s.active
+	}
+
+	if s.preferred != best {
+		s.preferred = best
+		s.since = now
+	}
+	if now.Sub(s.since) >= delay {
+		s.active = best
+	}
+	return old, old != s.active
+}
+
+func (s *poolState) get() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// rrsetPools returns the distinct pools of rrset's records, highest priority first
+func rrsetPools(rrset *RRSet) []int {
+	pools := make([]int, 0)
+	seen := make(map[int]bool)
+	for _, record := range rrset.Records {
+		if !seen[record.Pool] {
+			seen[record.Pool] = true
+			pools = append(pools, record.Pool)
+		}
+	}
+	sort.Ints(pools)
+	return pools
+}
+
+// poolMembers returns a copy of rrset holding only the records of pool
+func poolMembers(rrset *RRSet, pool int) *RRSet {
+	members := *rrset
+	members.Records = make([]Record, 0, len(rrset.Records))
+	for _, record := range rrset.Records {
+		if record.Pool == pool {
+			members.Records = append(members.Records, record)
+		}
+	}
+	return &members
+}
+
+// bestPool returns the highest priority pool with an available record, or the primary pool if none
+func (e *syncEngine) bestPool(domain *Domain, rrset *RRSet, pools []int) int {
+	check := e.healthCheckFor(domain, rrset)
+	for _, pool := range pools {
+		for i := range rrset.Records {
+			if rrset.Records[i].Pool == pool && e.recordAvailable(check, &rrset.Records[i]) {
+				return pool
+			}
+		}
+	}
+	return pools[0]
+}
+
+func (e *syncEngine) failbackDelay(rrset *RRSet) time.Duration {
+	if rrset.Failover != nil && rrset.Failover.FailbackDelay > 0 {
+		return time.Duration(rrset.Failover.FailbackDelay) * time.Second
+	}
+	return e.FailbackDelay
+}
+
+func (p *NexnsPlugin) failoverTTL(rrset *RRSet) int {
+	if rrset.Failover != nil && rrset.Failover.TTL > 0 {
+		return rrset.Failover.TTL
+	}
+	return p.FailoverTTL
+}
+
+// poolRecords returns the available records of the serving pool of rrset,
+// and whether the rrset has failed over from its primary pool
+func (e *syncEngine) poolRecords(domain *Domain, zone *Zone, rrset *RRSet) ([]Record, bool) {
+	pools := rrsetPools(rrset)
+	if len(pools) <= 1 {
+		return e.healthyRecords(domain, rrset), false
+	}
+
+	state, _ := e.pools.LoadOrStore(newRRsetKey(domain, zone, rrset), newPoolState(e.bestPool(domain, rrset, pools)))
+	active := state.(*poolState).get()
+
+	// serving pool was removed by an update, pick again until next evaluation
+	if i := sort.SearchInts(pools, active); i == len(pools) || pools[i] != active {
+		active = e.bestPool(domain, rrset, pools)
+	}
+
+	return e.healthyRecords(domain, poolMembers(rrset, active)), active != pools[0]
+}
+
+// updatePools re-evaluates the serving pool of every RRset with more than one pool
+func (e *syncEngine) updatePools(now time.Time) {
+	seen := make(map[rrsetKey]bool)
+
+	e.Database().Walk(func(domainData *DomainData) {
+		for z := range domainData.Zones {
+			zone := &domainData.Zones[z]
+			for i := range zone.RRsets {
+				rrset := &zone.RRsets[i]
+				pools := rrsetPools(rrset)
+				if len(pools) <= 1 {
+					continue
+				}
+				key := newRRsetKey(&domainData.Domain, zone, rrset)
+				seen[key] = true
+
+				best := e.bestPool(&domainData.Domain, rrset, pools)
+				state, _ := e.pools.LoadOrStore(key, newPoolState(best))
+				if old, changed := state.(*poolState).update(best, now, e.failbackDelay(rrset)); changed {
+					log.Warningf("RRset %s %s switched from pool %d to pool %d",
+						getFqdn(rrset.Name, domainData.Domain.Name), rrset.Type, old, state.(*poolState).get())
+				}
+			}
+		}
+	})
+
+	// forget RRsets which are no longer in the database
+	e.pools.Range(func(key, _ interface{}) bool {
+		if !seen[key.(rrsetKey)] {
+			e.pools.Delete(key)
+		}
+		return true
+	})
+}
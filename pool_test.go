@@ -0,0 +1,87 @@
+package nexns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoolStateHysteresis(t *testing.T) {
+	now := time.Now()
+	delay := time.Minute
+	state := newPoolState(0)
+
+	// primary pool down, switch to backup at once
+	if _, changed := state.update(1, now, delay); !changed || state.get() != 1 {
+		t.Fatalf("Expected immediate failover to pool 1, serving pool %d", state.get())
+	}
+
+	// primary pool back, but not for long enough
+	state.update(0, now.Add(10*time.Second), delay)
+	if state.get() != 1 {
+		t.Fatalf("Expected to stay on pool 1 before failback delay, serving pool %d", state.get())
+	}
+
+	// primary pool flaps, delay starts over
+	state.update(1, now.Add(20*time.Second), delay)
+	state.update(0, now.Add(30*time.Second), delay)
+	state.update(0, now.Add(80*time.Second), delay)
+	if state.get() != 1 {
+		t.Fatalf("Expected flapping pool 0 not to be served, serving pool %d", state.get())
+	}
+
+	state.update(0, now.Add(90*time.Second), delay)
+	if state.get() != 0 {
+		t.Fatalf("Expected failback to pool 0 after delay, serving pool %d", state.get())
+	}
+}
+
+func TestPoolRecordsFailover(t *testing.T) {
+	rrset, err := buildTestingRRset(OrderFixed, 0)
+	if err != nil {
+		t.Fatalf("Error building test rrset: %s", err)
+	}
+	rrset.Records[2].Pool = 1
+	rrset.Records[0].Down = true
+	rrset.Records[1].Down = true
+
+	p := &NexnsPlugin{FailoverTTL: 30, engine: newSyncEngine("")}
+	records := p.orderRecords(&Domain{Name: "example.com"}, &Zone{Name: "default"}, rrset)
+	if len(records) != 1 || records[0].ID != 3 {
+		t.Fatalf("Expected backup record 3 when primary pool is down, got %v", records)
+	}
+	if records[0].TTL != 30 {
+		t.Fatalf("Expected failover TTL 30, got %d", records[0].TTL)
+	}
+}
+
+func TestPoolStateSameID(t *testing.T) {
+	primaryDown, err := buildTestingRRset(OrderFixed, 0)
+	if err != nil {
+		t.Fatalf("Error building test rrset: %s", err)
+	}
+	primaryDown.ID = 0
+	primaryDown.Records[2].Pool = 1
+	primaryDown.Records[0].Down = true
+	primaryDown.Records[1].Down = true
+
+	primaryUp, _ := buildTestingRRset(OrderFixed, 0)
+	primaryUp.ID = 0
+	primaryUp.Records[2].Pool = 1
+
+	// RRsets of zone files all have id 0
+	domains := []DomainData{
+		{Domain: Domain{Name: "example.com"}, Zones: []Zone{{Name: "default", RRsets: []RRSet{*primaryDown}}}},
+		{Domain: Domain{Name: "test.com"}, Zones: []Zone{{Name: "default", RRsets: []RRSet{*primaryUp}}}},
+	}
+	e := buildTestingEngine(BuildTrie(domains))
+	e.updatePools(time.Now())
+
+	records, failedOver := e.poolRecords(&domains[0].Domain, &domains[0].Zones[0], &domains[0].Zones[0].RRsets[0])
+	if !failedOver || len(records) != 1 || records[0].ID != 3 {
+		t.Fatalf("Expected example.com to fail over to record 3, got %v", records)
+	}
+	records, failedOver = e.poolRecords(&domains[1].Domain, &domains[1].Zones[0], &domains[1].Zones[0].RRsets[0])
+	if failedOver || len(records) != 2 {
+		t.Fatalf("Expected test.com to stay on its primary pool, got %v", records)
+	}
+}
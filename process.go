@@ -11,55 +11,42 @@ import (
 const MaxPacketSize = 512
 const MaxTxtRecordSize = 255
 
-func (p *NexnsPlugin) searchRRset(queryName string, queryTypeString string, sourceIP net.IP) (*Domain, *RRSet) {
-	domainData := p.Database.Search(queryName)
+func (p *NexnsPlugin) searchRRset(queryName string, queryTypeString string, sourceIP net.IP) (*Domain, *Zone, *RRSet) {
+	domainData := p.database().Search(queryName)
 	return p.searchRRsetFromDomainData(domainData, queryName, queryTypeString, sourceIP)
 }
 
 // 搜索trie树，匹配domain中的RRset
-func (p *NexnsPlugin) searchRRsetFromDomainData(domainData *DomainData, queryName string, queryTypeString string, sourceIP net.IP) (*Domain, *RRSet) {
+func (p *NexnsPlugin) searchRRsetFromDomainData(domainData *DomainData, queryName string, queryTypeString string, sourceIP net.IP) (*Domain, *Zone, *RRSet) {
 
 	if domainData == nil {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	// find matching zone
-	for _, zone := range domainData.Zones {
+	for _, zone := range p.matchZones(domainData, sourceIP) {
 
-		for _, rule := range zone.Rules {
+		// find matching prefix's rrset
+		for _, rrset := range zone.RRsets {
 
-			_, ipNet, err := net.ParseCIDR(rule)
-			if err != nil {
-				continue
+			rrsetDomain := rrset.Name + "." + domainData.Domain.Name + "."
+			if len(rrset.Name) == 0 {
+				rrsetDomain = domainData.Domain.Name + "."
 			}
+			if rrsetDomain == queryName && rrset.Type == queryTypeString {
 
-			if ipNet.Contains(sourceIP) {
-
-				// find matching prefix's rrset
-				for _, rrset := range zone.RRsets {
-
-					rrsetDomain := rrset.Name + "." + domainData.Domain.Name + "."
-					if len(rrset.Name) == 0 {
-						rrsetDomain = domainData.Domain.Name + "."
-					}
-					if rrsetDomain == queryName && rrset.Type == queryTypeString {
-
-						// check if empty
-						if len(rrset.Records) == 0 {
-							return nil, nil
-						}
-						return &domainData.Domain, &rrset
-					}
-
+				// check if empty
+				if len(rrset.Records) == 0 {
+					return nil, nil, nil
 				}
-
+				return &domainData.Domain, zone, &rrset
 			}
 
 		}
 
 	}
 
-	return nil, nil
+	return nil, nil, nil
 }
 
 func (p *NexnsPlugin) writeAnswer(rrData *[]dns.RR, rrExtra *[]dns.RR, r *dns.Msg) (int, *dns.Msg) {
@@ -78,16 +65,16 @@ func (p *NexnsPlugin) writeAnswer(rrData *[]dns.RR, rrExtra *[]dns.RR, r *dns.Ms
 	return dns.RcodeSuccess, msg
 }
 
-func (p *NexnsPlugin) parseRRset(domain *Domain, rrset *RRSet, sourceIP net.IP) ([]dns.RR, []dns.RR) {
+func (p *NexnsPlugin) parseRRset(domain *Domain, zone *Zone, rrset *RRSet, sourceIP net.IP) ([]dns.RR, []dns.RR) {
 	rrDataset := make([]dns.RR, 0)
 	rrExtraset := make([]dns.RR, 0)
 
-	if domain == nil || rrset == nil {
+	if domain == nil || zone == nil || rrset == nil {
 		return rrDataset, rrExtraset
 	}
 
 	// regular records
-	for _, record := range rrset.Records {
+	for _, record := range p.orderRecords(domain, zone, rrset) {
 		ds, es := p.parseRecordData(domain, rrset, &record, sourceIP)
 		for _, rr := range ds {
 			rrDataset = append(rrDataset, rr)
@@ -164,8 +151,8 @@ func (p *NexnsPlugin) parseRecordData(domain *Domain, rrset *RRSet, record *Reco
 		rrDataset = append(rrDataset, rr)
 
 		// add additional A, AAAA records
-		ad1, arr1 := p.searchRRset(mx, "A", sourceIP)
-		dataA, extraA := p.parseRRset(ad1, arr1, sourceIP)
+		ad1, az1, arr1 := p.searchRRset(mx, "A", sourceIP)
+		dataA, extraA := p.parseRRset(ad1, az1, arr1, sourceIP)
 		for _, r := range dataA {
 			rrExtraset = append(rrDataset, r)
 		}
@@ -173,8 +160,8 @@ func (p *NexnsPlugin) parseRecordData(domain *Domain, rrset *RRSet, record *Reco
 			rrExtraset = append(rrDataset, r)
 		}
 
-		ad2, arr2 := p.searchRRset(mx, "AAAA", sourceIP)
-		dataAAAA, extraAAAA := p.parseRRset(ad2, arr2, sourceIP)
+		ad2, az2, arr2 := p.searchRRset(mx, "AAAA", sourceIP)
+		dataAAAA, extraAAAA := p.parseRRset(ad2, az2, arr2, sourceIP)
 		for _, r := range dataAAAA {
 			rrExtraset = append(rrDataset, r)
 		}
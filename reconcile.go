@@ -0,0 +1,116 @@
+package nexns
+
+import (
+	"fmt"
+	"time"
+)
+
+const DefaultReconcileInterval = 10 * time.Minute
+
+// DomainSerial 包含了 Controller 上域名的当前序列号
+type DomainSerial struct {
+	ID     int    `json:"id"`
+	Name   string `json:"domain"`
+	Serial string `json:"serial"`
+}
+
+func (c *Controller) fetchDomainSerials() ([]DomainSerial, error) {
+	serials := make([]DomainSerial, 0)
+	err := c.getJSON(c.controllerURL()+"api/v1/domain/serial/", &serials)
+	if err != nil {
+		return nil, err
+	}
+
+	return serials, nil
+}
+
+// reconcile compares local domain serials with the controller's and refetches only the
+// domains which differ. Falls back to pulling all data if serials are not available.
+func (c *Controller) reconcile() (err error) {
+	defer func() { c.countSync("reconcile", err) }()
+
+	log.Debugf("Reconciling with %s.", c.name())
+
+	serials, err := c.fetchDomainSerials()
+	if err != nil {
+		log.Warningf("Failed to get domain serials, pulling all data: %v", err)
+		return c.loadAllFromSource()
+	}
+	err = c.checkSerials(serials)
+	if err != nil {
+		return err
+	}
+
+	local := make(map[string]Domain)
+	c.engine.updateLock.Lock()
+	for name, domainData := range c.domains {
+		local[name] = domainData.Domain
+	}
+	c.engine.updateLock.Unlock()
+
+	changed := make([]*DomainData, 0)
+	for _, serial := range serials {
+		domain, exists := local[serial.Name]
+		delete(local, serial.Name)
+		if exists && domain.ID == serial.ID && domain.Serial == serial.Serial {
+			continue
+		}
+
+		domainData, err := c.source.LoadDomain(serial.ID)
+		if err != nil {
+			return fmt.Errorf("failed to load domain id %d: %v", serial.ID, err)
+		}
+		changed = append(changed, domainData)
+	}
+
+	// domains left in local were removed on the controller
+	if len(changed) == 0 && len(local) == 0 {
+		log.Debug("Reconciled, no changes.")
+		return nil
+	}
+
+	c.engine.updateLock.Lock()
+	names := make([]string, 0, len(changed)+len(local))
+	for _, domainData := range changed {
+		domainData.Source = c.name()
+		c.domains[domainData.Domain.Name] = domainData
+		names = append(names, domainData.Domain.Name)
+	}
+	for name := range local {
+		delete(c.domains, name)
+		names = append(names, name)
+	}
+	c.engine.mergeDomains(names)
+	c.engine.updateLock.Unlock()
+	c.engine.updateSnapshot()
+
+	log.Infof("Reconciled with %s, %d domains updated, %d domains removed.", c.name(), len(changed), len(local))
+
+	return nil
+}
+
+// runReconcile reconciles every ReconcileInterval until stop is closed
+func (c *Controller) runReconcile(stop <-chan struct{}) {
+	if c.ReconcileInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.ReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !c.Ready() {
+			continue
+		}
+		err := c.reconcile()
+		if err != nil {
+			log.Errorf("Failed to reconcile: %v", err)
+		}
+	}
+}
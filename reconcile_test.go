@@ -0,0 +1,52 @@
+package nexns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReconcileSerials(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+
+	fetched := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		switch r.URL.Path {
+		case "/api/v1/domain/serial/":
+			// example.com changed, top removed
+			w.Write([]byte(`[
+				{"id": 1, "domain": "example.com", "serial": "123456790"},
+				{"id": 2, "domain": "sub.example.com", "serial": "123456789"},
+				{"id": 3, "domain": "test.com", "serial": "123456789"}
+			]`))
+		case "/api/v1/domain/1/dump/":
+			w.Write([]byte(`{
+				"domain": {"id": 1, "domain": "example.com", "serial": "123456790"},
+				"zones": []
+			}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	e := buildTestingEngine(trie)
+	controller := buildTestingController(e, server.URL+"/")
+	if err := controller.reconcile(); err != nil {
+		t.Fatalf("Error reconciling: %s", err)
+	}
+
+	if len(fetched) != 2 {
+		t.Fatalf("Expected only serials and example.com to be fetched, got %v", fetched)
+	}
+	if domainData := e.Database().Search("example.com."); domainData == nil || domainData.Domain.Serial != "123456790" {
+		t.Fatalf("Expected example.com to be updated")
+	}
+	if domainData := e.Database().Search("www.top."); domainData != nil {
+		t.Fatalf("Expected top to be removed")
+	}
+}
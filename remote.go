@@ -1,133 +1,596 @@
 package nexns
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
 )
 
-func (p *NexnsPlugin) RequestWithCredentials(url string) (*http.Response, error) {
+// controllerClient is used for requests to the controller when no transport was built, so a hung controller
+// can't block loading forever
+var controllerClient = &http.Client{
+	Transport: newReadTimeoutTransport(http.DefaultTransport.(*http.Transport).Clone(), DefaultReadTimeout),
+}
+
+// redactURL strips credentials and query from a URL, so it can be logged
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid url>"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+func (c *Controller) RequestWithCredentials(url string) (*http.Response, error) {
+	req, err := c.newRequestWithCredentials(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.doRequest(req)
+}
+
+func (c *Controller) newRequestWithCredentials(url string) (*http.Request, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		fmt.Println("Error creating request:", err)
 		return nil, err
 	}
 
 	// Add auth headers
-	req.Header.Add("X-CLIENT-ID", p.ClientId)
-	req.Header.Add("X-CLIENT-SECRET", p.ClientSecret)
+	err = c.authenticator().Authenticate(req)
+	if err != nil {
+		return nil, fmt.Errorf("authenticate request error: %v", err)
+	}
+
+	return req, nil
+}
+
+func (c *Controller) doRequest(req *http.Request) (*http.Response, error) {
+	// Ask for a compressed body, it's decoded in decodeBody
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
 
 	// Do request
-	response, err := http.DefaultClient.Do(req)
+	response, err := c.httpClient().Do(req)
+	c.checkResponse(req, response, err)
 	if err != nil {
-		fmt.Println("Error making request:", err)
 		return nil, err
 	}
 	// defer response.Body.Close()
 
+	c.checkUnauthorized(response)
+
 	return response, nil
 }
 
-func (p *NexnsPlugin) loadAllDataFromURL() error {
-
-	log.Println("[Nexns] Pulling all data from server.")
-
-	// Create a request
-	response, err := p.RequestWithCredentials(p.ControllerURL + "api/v1/domain/dump/")
+// getJSON requests an endpoint of the controller and decodes its JSON response into v
+func (c *Controller) getJSON(endpoint string, v interface{}) error {
+	response, err := c.RequestWithCredentials(endpoint)
 	if err != nil {
-		return fmt.Errorf("HTTP request error: %v", err)
+		return endpointError(endpoint, "request failed: %v", err)
 	}
 	defer response.Body.Close()
 
-	// Read response body
-	body, err := io.ReadAll(response.Body)
+	return c.readJSON(endpoint, response, v)
+}
+
+// acceptEncoding lists the content encodings the controller may compress responses with
+const acceptEncoding = "zstd, gzip"
+
+// limitedBody counts bytes read and fails once more than limit bytes were read, so a large or highly
+// compressed body can't exhaust memory
+type limitedBody struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, fmt.Errorf("response body larger than %d bytes", l.limit)
+	}
+	return n, err
+}
+
+// decodeBody checks the response status and passes a JSON decoder reading the decompressed body, limited to
+// MaxBodySize bytes, to decode
+func (c *Controller) decodeBody(endpoint string, response *http.Response, decode func(*json.Decoder) error) error {
+	// token requests are POSTs, everything else GETs
+	method := http.MethodGet
+	if response.Request != nil {
+		method = response.Request.Method
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return requestError(method, endpoint, "unexpected status %s", response.Status)
+	}
+
+	maxBodySize := c.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+
+	var body io.Reader = response.Body
+	switch encoding := strings.ToLower(response.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip":
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			return requestError(method, endpoint, "gzip decoding error: %v", err)
+		}
+		body = reader
+	case "zstd":
+		decoder, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(uint64(max(maxBodySize, zstd.MinWindowSize))))
+		if err != nil {
+			return requestError(method, endpoint, "zstd decoding error: %v", err)
+		}
+		defer decoder.Close()
+		body = decoder
+	default:
+		return requestError(method, endpoint, "unsupported content encoding %q", encoding)
+	}
+
+	// the limit applies to the decompressed body
+	limited := &limitedBody{reader: body, limit: maxBodySize}
+	err := decode(json.NewDecoder(limited))
+	if limited.read > limited.limit || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		return requestError(method, endpoint, "response body larger than %d bytes", maxBodySize)
+	}
 	if err != nil {
-		return fmt.Errorf("Read response body error: %v", err)
+		return requestError(method, endpoint, "JSON parsing error: %v", err)
 	}
 
-	domainDataList := make([]DomainData, 0)
+	return nil
+}
+
+// readJSON decodes the JSON response of an endpoint into v
+func (c *Controller) readJSON(endpoint string, response *http.Response, v interface{}) error {
+	return c.decodeBody(endpoint, response, func(decoder *json.Decoder) error {
+		return decoder.Decode(v)
+	})
+}
+
+// readDump decodes a dump, passing each domain to add as soon as it's decoded, so neither the body nor the
+// decoded dump is held in memory as a whole. The serials of the dump are checked once it was decoded.
+func (c *Controller) readDump(endpoint string, response *http.Response, add func(domainData *DomainData)) error {
+	serials := make([]DomainSerial, 0)
+	err := c.decodeBody(endpoint, response, func(decoder *json.Decoder) error {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if token != json.Delim('[') {
+			return fmt.Errorf("expected an array of domains, got %v", token)
+		}
+
+		for decoder.More() {
+			domainData := &DomainData{}
+			err = decoder.Decode(domainData)
+			if err != nil {
+				return err
+			}
+			serials = append(serials, DomainSerial{ID: domainData.Domain.ID, Name: domainData.Domain.Name, Serial: domainData.Domain.Serial})
+			add(domainData)
+		}
 
-	// Parse JSON data
-	err = json.Unmarshal(body, &domainDataList)
+		_, err = decoder.Token()
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("JSON parsing error: %v", err)
+		return err
 	}
 
-	p.Database = *BuildTrie(domainDataList)
+	return c.checkSerials(serials)
+}
 
-	log.Println("[Nexns] Successfully pulled all data from server.")
+// endpointError describes a failed request to a controller endpoint
+func endpointError(endpoint string, format string, args ...interface{}) error {
+	return requestError(http.MethodGet, endpoint, format, args...)
+}
 
-	return nil
+// requestError describes a failed request to an endpoint
+func requestError(method string, endpoint string, format string, args ...interface{}) error {
+	return fmt.Errorf("%s %s: %s", method, redactURL(endpoint), fmt.Sprintf(format, args...))
+}
+
+// remoteSource is the data of a NexNS Controller, synced over its API
+type remoteSource struct {
+	controller *Controller
+}
+
+func (s *remoteSource) String() string {
+	if len(s.controller.URLs) == 0 {
+		return ""
+	}
+	return redactURL(s.controller.URLs[0])
 }
 
-func (p *NexnsPlugin) loadDomainDataFromURL(domainId int) error {
+// GoString describes the settings of the controller, which are part of the engine key
+func (s *remoteSource) GoString() string {
+	c := s.controller
+	secretFile := ""
+	if c.secretFile != nil {
+		secretFile = c.secretFile.path
+	}
+	auth := AuthHeader
+	switch a := c.auth.(type) {
+	case *hmacAuth:
+		auth = AuthHMAC
+	case *bearerAuth:
+		auth = fmt.Sprintf("%s %q %q", AuthBearer, a.tokenURL, a.scopes)
+	}
+	serverName := ""
+	if c.TLSConfig != nil {
+		serverName = c.TLSConfig.ServerName
+	}
 
-	log.Println("[Nexns] Loading domain id:", domainId)
+	return fmt.Sprintf("controller %q client %q %q %q auth %s tls %q %q %q proxy %q timeouts %s %s %d sync %s %s %s %q %s",
+		c.URLs, c.ClientId, c.ClientSecret, secretFile, auth,
+		c.tlsArgs, serverName, c.TLSPins, c.ProxyURL, c.ConnectTimeout, c.ReadTimeout, c.MaxBodySize,
+		c.SyncMode, c.PollInterval, c.NotifyTransport, c.NotifyAddress, c.ReconcileInterval)
+}
 
-	// Send HTTP GET request
-	response, err := p.RequestWithCredentials(p.ControllerURL + "api/v1/domain/" + strconv.Itoa(domainId) + "/dump/")
+// LoadAll pulls the dump of all domains
+func (s *remoteSource) LoadAll() ([]*DomainData, error) {
+	domainDataList := make([]*DomainData, 0)
+	err := s.StreamAll(func(domainData *DomainData) {
+		domainDataList = append(domainDataList, domainData)
+	})
 	if err != nil {
-		return fmt.Errorf("HTTP request error: %v", err)
+		return nil, err
 	}
-	defer response.Body.Close()
+	return domainDataList, nil
+}
+
+// StreamAll pulls the dump of all domains, passing each domain to add as soon as it's decoded
+func (s *remoteSource) StreamAll(add func(domainData *DomainData)) error {
+	c := s.controller
+	log.Infof("Pulling all data from %s.", c.name())
 
-	// Read response body
-	body, err := io.ReadAll(response.Body)
+	endpoint := c.controllerURL() + "api/v1/domain/dump/"
+	response, err := c.RequestWithCredentials(endpoint)
 	if err != nil {
-		return fmt.Errorf("Read response body error: %v", err)
+		return endpointError(endpoint, "request failed: %v", err)
 	}
+	defer response.Body.Close()
+
+	return c.readDump(endpoint, response, add)
+}
 
+// LoadDomain pulls the dump of one domain
+func (s *remoteSource) LoadDomain(id int) (*DomainData, error) {
+	c := s.controller
 	domainData := &DomainData{}
+	err := c.getJSON(c.controllerURL()+"api/v1/domain/"+strconv.Itoa(id)+"/dump/", domainData)
+	if err != nil {
+		return nil, err
+	}
+
+	return domainData, nil
+}
+
+// Watch runs the poll loop, or pulls all data and receives notifications, until stop is closed.
+// Polled dumps and changes carried by notifications are applied by the controller directly.
+func (s *remoteSource) Watch(stop <-chan struct{}, changed func(id int) error) {
+	c := s.controller
+
+	redacted := make([]string, 0, len(c.URLs))
+	for _, url := range c.URLs {
+		redacted = append(redacted, redactURL(url))
+	}
+	log.Infof("Controller %s URL: %s", c.name(), strings.Join(redacted, ", "))
+
+	// controller endpoints in priority order
+	c.endpoints = newControllerEndpoints(c.name(), c.URLs)
+	endpointActiveGauge.WithLabelValues(c.name(), redactURL(c.URLs[0])).Set(1)
+	c.notifyState.controller = c.name()
+
+	// recover notifications missed while the notification channel was down
+	go c.runReconcile(stop)
 
-	// Parse JSON data
-	err = json.Unmarshal(body, &domainData)
+	// fail back to preferred controller endpoints once they recover
+	go c.runControllerFailback(stop)
+
+	if c.SyncMode == SyncPoll {
+		// poll for changed data, the first poll pulls all data
+		c.runPoll(stop)
+		return
+	}
+
+	// pull all data in background, retrying until the controller is reachable, so notifications
+	// are received meanwhile
+	go func() {
+		for changed(0) != nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}()
+
+	// notification channel to recv changes
+	c.runNotificationChannel(stop)
+}
+
+// applyAllData replaces the domains of the controller with a full dump
+func (c *Controller) applyAllData(domainDataList []DomainData) {
+	dump := make([]*DomainData, 0, len(domainDataList))
+	for i := range domainDataList {
+		dump = append(dump, &domainDataList[i])
+	}
+	c.applyDump(dump)
+}
+
+// applyDump replaces the domains of the controller with a decoded dump
+func (c *Controller) applyDump(domainDataList []*DomainData) {
+	merge := c.newDumpMerge()
+	for _, domainData := range domainDataList {
+		merge.add(domainData)
+	}
+	merge.finish()
+}
+
+// applyDomainData inserts or replaces one domain of the controller
+func (c *Controller) applyDomainData(domainData *DomainData) {
+	c.engine.updateLock.Lock()
+	domainData.Source = c.name()
+	c.domains[domainData.Domain.Name] = domainData
+	c.engine.mergeDomains([]string{domainData.Domain.Name})
+	c.engine.updateLock.Unlock()
+	c.engine.updateSnapshot()
+}
+
+const (
+	notifyPingPeriod = 30 * time.Second
+	notifyPongWait   = 60 * time.Second
+	notifyWriteWait  = 10 * time.Second
+	notifyMinBackoff = 1 * time.Second
+	notifyMaxBackoff = 5 * time.Minute
+)
+
+// connectionState tracks the notification channel for monitoring
+type connectionState struct {
+	controller  string
+	connected   atomic.Bool
+	lastMessage atomic.Int64 // unix time of last message or pong
+}
+
+func (s *connectionState) up() {
+	s.connected.Store(true)
+	notifyConnectedGauge.WithLabelValues(s.controller).Set(1)
+	s.seen()
+}
+
+func (s *connectionState) down() {
+	s.connected.Store(false)
+	notifyConnectedGauge.WithLabelValues(s.controller).Set(0)
+}
+
+func (s *connectionState) seen() {
+	now := time.Now().Unix()
+	s.lastMessage.Store(now)
+	notifyLastMessageGauge.WithLabelValues(s.controller).Set(float64(now))
+}
+
+// Connected reports whether the notification channel is up
+func (s *connectionState) Connected() bool {
+	return s.connected.Load()
+}
+
+// LastMessage returns when the notification channel last heard from the server
+func (s *connectionState) LastMessage() time.Time {
+	return time.Unix(s.lastMessage.Load(), 0)
+}
+
+// runNotificationChannel keeps the notification channel connected until stop is closed
+func (c *Controller) runNotificationChannel(stop <-chan struct{}) {
+	retry := backoff{Min: notifyMinBackoff, Max: notifyMaxBackoff}
+
+	for {
+		connected, err := c.connectToNotificationChannel(stop)
+		if connected {
+			retry.Reset()
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		switch {
+		case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseServiceRestart, websocket.CloseTryAgainLater):
+			log.Warningf("Notification channel of %s closed by server: %v", c.name(), err)
+		case errors.Is(err, errNotifyRejected) || websocket.IsCloseError(err, websocket.ClosePolicyViolation) || isApplicationCloseError(err):
+			// rejected by server, e.g. bad credentials, don't hammer it
+			log.Errorf("Notification channel of %s rejected by server: %v", c.name(), err)
+			retry.Exhaust()
+		}
+
+		delay := retry.Next()
+		log.Infof("Reconnecting to notification channel of %s in %s", c.name(), delay)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isApplicationCloseError reports whether err is a close frame with an application defined code (4000-4999)
+func isApplicationCloseError(err error) bool {
+	closeErr, ok := err.(*websocket.CloseError)
+	return ok && closeErr.Code >= 4000 && closeErr.Code <= 4999
+}
+
+// connectToNotificationChannel reads notifications until the connection fails or stop is closed.
+// Returns whether the connection was established.
+func (c *Controller) connectToNotificationChannel(stop <-chan struct{}) (bool, error) {
+
+	log.Debugf("Connecting to notification channel of %s.", c.name())
+
+	endpoint := c.controllerURL()
+	var switched <-chan struct{}
+	if c.endpoints != nil {
+		switched = c.endpoints.watch()
+	}
+
+	source := c.newNotifySource()
+	endpointFailed, err := source.connect(endpoint)
 	if err != nil {
-		return fmt.Errorf("JSON parsing error: %v", err)
+		if c.endpoints != nil && endpointFailed {
+			c.endpoints.fail(endpoint)
+		}
+		log.Warningf("Failed to connect to notification channel of %s: %v", c.name(), err)
+		return false, err
 	}
+	log.Infof("Successfully connected to notification channel of %s.", redactURL(endpoint))
+	defer source.close()
 
-	p.Database.Insert(domainData)
+	c.notifyState.up()
+	defer c.notifyState.down()
 
-	log.Println("[Nexns] Successfully loaded domain id:", domainId)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(notifyPingPeriod)
+		defer ticker.Stop()
 
-	return nil
+		for {
+			select {
+			case <-done:
+				return
+			case <-stop:
+				source.close()
+				return
+			case <-switched:
+				// reconnect to the new active endpoint
+				log.Info("Controller endpoint switched, reconnecting notification channel.")
+				source.close()
+				return
+			case <-ticker.C:
+				err := source.ping()
+				if err != nil {
+					source.close()
+					return
+				}
+			}
+		}
+	}()
+
+	// notifications may have been missed while disconnected
+	if c.Ready() {
+		err = c.reconcile()
+		if err != nil {
+			log.Errorf("Failed to reconcile after reconnect: %v", err)
+		}
+	}
+
+	for {
+		notification, err := source.receive()
+		if err != nil {
+			log.Warningf("Notification channel of %s closed: %v", c.name(), err)
+			return true, err
+		}
+		notificationCount.WithLabelValues(c.name()).Inc()
+
+		err = c.syncDomain(*notification)
+		if err != nil {
+			log.Errorf("Failed to load domain id %d: %v", notification.Domain, err)
+		}
+
+		err = source.ack(notification, err)
+		if err != nil {
+			log.Warningf("Failed to acknowledge notification of domain id %d: %v", notification.Domain, err)
+		}
+	}
 }
 
-func (p *NexnsPlugin) connectToNotificationChannel() error {
+// wsSource receives notifications over the WebSocket endpoint of the controller
+type wsSource struct {
+	controller *Controller
+	conn       *websocket.Conn
+}
 
-	log.Println("[Nexns] Connecting to notification channel.")
+func (s *wsSource) connect(endpoint string) (bool, error) {
+	c := s.controller
 
-	controllerURL := strings.Replace(p.ControllerURL, "http", "ws", 1)
-	headers := http.Header{}
-	headers.Add("X-CLIENT-ID", p.ClientId)
-	headers.Add("X-CLIENT-SECRET", p.ClientSecret)
-	conn, _, err := websocket.DefaultDialer.Dial(controllerURL+"api/v1/ws/client-notify/", headers)
+	controllerURL := strings.Replace(endpoint, "http", "ws", 1)
+	handshake, err := c.newRequestWithCredentials(controllerURL + "api/v1/ws/client-notify/")
 	if err != nil {
-		log.Println("[Nexns] Failed to connect to notification channel:", err)
-		return err
+		return false, err
 	}
-	log.Println("[Nexns] Successfully connected to notification channel.")
-	defer conn.Close()
+	conn, response, err := c.wsDialer().Dial(handshake.URL.String(), handshake.Header)
+	if response != nil {
+		c.checkUnauthorized(response)
+	}
+	if err != nil && response != nil && (response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden) {
+		return false, fmt.Errorf("%w: %s", errNotifyRejected, response.Status)
+	}
+	if err != nil {
+		return response == nil || response.StatusCode >= 500, err
+	}
+	s.conn = conn
+
+	// a half-open connection never sends pongs, so the read deadline expires
+	conn.SetReadDeadline(time.Now().Add(notifyPongWait))
+	conn.SetPongHandler(func(string) error {
+		c.notifyState.seen()
+		return conn.SetReadDeadline(time.Now().Add(notifyPongWait))
+	})
 
+	return false, nil
+}
+
+func (s *wsSource) receive() (*WSNotification, error) {
 	for {
 		// 从上游服务器读取消息
-		_, msg, err := conn.ReadMessage()
+		_, msg, err := s.conn.ReadMessage()
 		if err != nil {
-			log.Println("[Nexns] WebSocket connection closed. Attempting to reconnect.")
-			return err
+			return nil, err
 		}
+		s.conn.SetReadDeadline(time.Now().Add(notifyPongWait))
+		s.controller.notifyState.seen()
 
-		notificationData := WSNotification{}
-		err = json.Unmarshal(msg, &notificationData)
+		notificationData := &WSNotification{}
+		err = json.Unmarshal(msg, notificationData)
 		if err != nil {
-			log.Println("[Nexns] Error parsing notification data:", err)
+			log.Errorf("Error parsing notification data: %v", err)
+			continue
 		}
 
-		p.loadDomainDataFromURL(notificationData.Domain)
+		return notificationData, nil
 	}
 }
+
+// ack is not supported by the WebSocket endpoint
+func (s *wsSource) ack(notification *WSNotification, applyErr error) error {
+	return nil
+}
+
+func (s *wsSource) ping() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(notifyWriteWait))
+}
+
+func (s *wsSource) close() {
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(notifyWriteWait))
+	s.conn.Close()
+}
@@ -0,0 +1,296 @@
+package nexns
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestLoadRejectsBadResponses(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error/api/v1/domain/dump/":
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`<html>Bad Gateway</html>`))
+		case "/large/api/v1/domain/dump/":
+			w.Write([]byte(`[` + strings.Repeat(" ", 100) + `]`))
+		case "/truncated/api/v1/domain/dump/":
+			w.Write([]byte(`[{"domain": {"id": 9, "domain": "new.com", "serial": "1"}}, {"domain": `))
+		}
+	}))
+	defer server.Close()
+
+	e := buildTestingEngine(trie)
+	controller := newController(e)
+	controller.URLs = []string{server.URL + "/error/"}
+	controller.MaxBodySize = 64
+
+	err = controller.loadAllFromSource()
+	if err == nil || !strings.Contains(err.Error(), "/error/api/v1/domain/dump/") || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("Expected error naming endpoint and status, got %v", err)
+	}
+
+	controller.URLs = []string{server.URL + "/large/"}
+	err = controller.loadAllFromSource()
+	if err == nil || !strings.Contains(err.Error(), "larger than 64 bytes") {
+		t.Fatalf("Expected body size error, got %v", err)
+	}
+
+	// domains decoded before the error are not applied
+	controller.URLs = []string{server.URL + "/truncated/"}
+	controller.MaxBodySize = 0
+	err = controller.loadAllFromSource()
+	if err == nil || !strings.Contains(err.Error(), "JSON parsing error") {
+		t.Fatalf("Expected parsing error, got %v", err)
+	}
+	if e.Database().Search("new.com.") != nil {
+		t.Fatalf("Expected domains of a truncated dump not to be served")
+	}
+
+	if e.Database().Search("example.com.") == nil {
+		t.Fatalf("Expected database to be kept after failed loads")
+	}
+}
+
+func TestLoadCompressedDump(t *testing.T) {
+	dump := buildTestingDump(3)
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(dump)
+	gz.Close()
+	zstdEncoder, _ := zstd.NewWriter(nil)
+	bomb := zstdEncoder.EncodeAll([]byte(`[`+strings.Repeat(" ", 1<<20)+`]`), nil)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "zstd, gzip" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		switch r.URL.Path {
+		case "/gzip/api/v1/domain/dump/":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped.Bytes())
+		case "/zstd/api/v1/domain/dump/":
+			w.Header().Set("Content-Encoding", "zstd")
+			w.Write(zstdEncoder.EncodeAll(dump, nil))
+		case "/bomb/api/v1/domain/dump/":
+			w.Header().Set("Content-Encoding", "zstd")
+			w.Write(bomb)
+		}
+	}))
+	defer server.Close()
+
+	for _, encoding := range []string{"gzip", "zstd"} {
+		e := newSyncEngine("")
+		controller := newController(e)
+		controller.URLs = []string{server.URL + "/" + encoding + "/"}
+		e.Controllers = []*Controller{controller}
+
+		err := controller.loadAllFromSource()
+		if err != nil {
+			t.Fatalf("Error loading %s dump: %s", encoding, err)
+		}
+		if domainData := e.Database().Search("www.domain2.com."); domainData == nil || domainData.Domain.ID != 2 {
+			t.Fatalf("Expected domains of %s dump to be loaded", encoding)
+		}
+	}
+
+	// the size limit applies to the decompressed body
+	controller := newController(newSyncEngine(""))
+	controller.URLs = []string{server.URL + "/bomb/"}
+	controller.MaxBodySize = 64 << 10
+	err := controller.loadAllFromSource()
+	if err == nil || !strings.Contains(err.Error(), "larger than 65536 bytes") {
+		t.Fatalf("Expected body size error, got %v", err)
+	}
+}
+
+func TestRemoteSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/domain/dump/":
+			w.Write(buildTestingDump(2))
+		case "/api/v1/domain/1/dump/":
+			fmt.Fprint(w, `{"domain": {"id": 1, "domain": "domain1.com", "serial": "2024010102"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	e := newSyncEngine("")
+	controller := newController(e)
+	controller.URLs = []string{server.URL + "/"}
+	controller.NotifyTransport = NotifySSE
+	controller.ReconcileInterval = 0
+	e.Controllers = []*Controller{controller}
+	if controller.name() != server.URL+"/" {
+		t.Fatalf("Expected the controller URL as name, got %q", controller.name())
+	}
+
+	// all data is pulled when started
+	stop := make(chan struct{})
+	defer close(stop)
+	controller.start(stop)
+	for i := 0; i < 100 && !controller.Ready(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if domainData := e.Database().Search("domain1.com."); domainData == nil || domainData.Domain.Serial != "2024010101" {
+		t.Fatalf("Expected data of the controller to be loaded, got %+v", domainData)
+	}
+
+	if err := controller.loadDomainFromSource(1); err != nil {
+		t.Fatalf("Error loading domain: %s", err)
+	}
+	if domainData := e.Database().Search("domain1.com."); domainData == nil || domainData.Domain.Serial != "2024010102" {
+		t.Fatalf("Expected domain to be reloaded, got %+v", domainData)
+	}
+
+	other := newController(e)
+	other.URLs = []string{server.URL + "/other/"}
+	if controller.key() == other.key() {
+		t.Fatalf("Expected controllers with different URLs to have different keys")
+	}
+}
+
+// buildTestingDump returns a dump of n domains, each with a zone of a few RRsets
+func buildTestingDump(n int) []byte {
+	domainDataList := make([]DomainData, 0, n)
+	for i := 1; i <= n; i++ {
+		name := fmt.Sprintf("domain%d.com", i)
+		domainDataList = append(domainDataList, DomainData{
+			Domain: Domain{ID: i, Name: name, Mname: "ns1." + name, Rname: "admin." + name, Serial: "2024010101", TTL: 600},
+			Zones: []Zone{{
+				ID:    i,
+				Name:  "default",
+				Rules: []string{"0.0.0.0/0", "::/0"},
+				RRsets: []RRSet{
+					{ID: 3*i - 2, Name: "", Type: "A", Records: []Record{{ID: 4*i - 3, TTL: 600, Data: "192.0.2.1"}, {ID: 4*i - 2, TTL: 600, Data: "192.0.2.2"}}},
+					{ID: 3*i - 1, Name: "www", Type: "CNAME", Records: []Record{{ID: 4*i - 1, TTL: 600, Data: name + "."}}},
+					{ID: 3 * i, Name: "", Type: "MX", Records: []Record{{ID: 4 * i, TTL: 600, Data: "10 mail." + name + "."}}},
+				},
+			}},
+		})
+	}
+	dump, _ := json.Marshal(domainDataList)
+	return dump
+}
+
+// measurePeakHeap runs f and returns the highest heap growth seen while it ran
+func measurePeakHeap(f func()) uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapAlloc
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > base && stats.HeapAlloc-base > peak {
+				peak = stats.HeapAlloc - base
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	f()
+	close(done)
+	<-sampled
+	return peak
+}
+
+func BenchmarkLoadAllData(b *testing.B) {
+	dump := buildTestingDump(100000)
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(dump)
+	gz.Close()
+	zstdEncoder, _ := zstd.NewWriter(nil)
+	bodies := map[string][]byte{
+		"identity": dump,
+		"gzip":     gzipped.Bytes(),
+		"zstd":     zstdEncoder.EncodeAll(dump, nil),
+	}
+
+	// the former loading: whole body read, then unmarshalled, then the trie built
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(dump)
+	}))
+	b.Run("baseline", func(b *testing.B) {
+		var peak uint64
+		for i := 0; i < b.N; i++ {
+			peak += measurePeakHeap(func() {
+				response, err := http.Get(server.URL + "/")
+				if err != nil {
+					b.Fatalf("Error loading data: %s", err)
+				}
+				body, err := io.ReadAll(response.Body)
+				response.Body.Close()
+				if err != nil {
+					b.Fatalf("Error loading data: %s", err)
+				}
+				var domainDataList []DomainData
+				if err := json.Unmarshal(body, &domainDataList); err != nil {
+					b.Fatalf("Error parsing data: %s", err)
+				}
+				BuildTrie(domainDataList)
+			})
+		}
+		b.ReportMetric(float64(peak)/float64(b.N)/(1<<20), "peak-MB")
+	})
+	server.Close()
+
+	for _, encoding := range []string{"identity", "gzip", "zstd"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if encoding != "identity" && strings.Contains(r.Header.Get("Accept-Encoding"), encoding) {
+				w.Header().Set("Content-Encoding", encoding)
+				w.Write(bodies[encoding])
+				return
+			}
+			w.Write(dump)
+		}))
+
+		b.Run(encoding, func(b *testing.B) {
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				controller := newController(newSyncEngine(""))
+				controller.URLs = []string{server.URL + "/"}
+				controller.engine.Controllers = []*Controller{controller}
+				peak += measurePeakHeap(func() {
+					if err := controller.loadAllFromSource(); err != nil {
+						b.Fatalf("Error loading data: %s", err)
+					}
+				})
+			}
+			b.ReportMetric(float64(peak)/float64(b.N)/(1<<20), "peak-MB")
+		})
+		server.Close()
+	}
+}
@@ -7,70 +7,642 @@
 package nexns
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/miekg/dns"
 )
 
 /*
 	Nexns plugin definition
 */
 
+var log = clog.NewWithPlugin("nexns")
+
 func setup(c *caddy.Controller) error {
+	nexns_plugin, err := parse(c)
+	if err != nil {
+		return err
+	}
+
+	// Initialize the plugin on startup, so a failed reload does not hold on to a sync engine
+	c.OnStartup(func() error {
+		err := nexns_plugin.Init()
+		if err != nil {
+			return plugin.Error(nexns_plugin.Name(), fmt.Errorf("failed to init: %v", err))
+		}
+		return nil
+	})
+	c.OnStartup(func() error {
+		metrics.MustRegister(c, queryCount, fallthroughCount, viewNoMatchCount,
+			healthCheckCount, healthStatusGauge,
+			notifyConnectedGauge, notifyLastMessageGauge, notificationCount,
+			syncCount, lastSyncGauge, endpointActiveGauge, domainsGauge, recordsGauge)
+		return nil
+	})
+	c.OnShutdown(nexns_plugin.Shutdown)
+
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		nexns_plugin.Next = next
+		return nexns_plugin
+	})
 
-	nexns_plugin := &NexnsPlugin{}
+	return nil
+}
+
+// parse reads the nexns block of a server block
+func parse(c *caddy.Controller) (*NexnsPlugin, error) {
+
+	nexns_plugin := &NexnsPlugin{
+		engine:      newSyncEngine(""),
+		NotReady:    NotReadyServfail,
+		Order:       OrderFixed,
+		FailoverTTL: DefaultFailoverTTL,
+	}
+
+	// controller options outside of controller blocks configure the controller declared without a block
+	default_controller := newController(nexns_plugin.engine)
+	flat_options := false
 
 	c.Next() // 'nexns'
 
+	// nexns [ZONES...]
+	nexns_plugin.Zones = plugin.OriginsFromArgsOrServerBlock(c.RemainingArgs(), c.ServerBlockKeys)
+
 	for c.NextBlock() { // nexns {...}
 		switch c.Val() {
 		case "controller":
+			// controller URL [URL...] [{...}]
+			config_urls := c.RemainingArgs()
+			if len(config_urls) == 0 {
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			}
+
+			controller := default_controller
+			if c.NextArg() {
+				if c.Val() != "{" {
+					return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+				}
+				controller = newController(nexns_plugin.engine)
+				if err := parseControllerBlock(c, controller); err != nil {
+					return nil, plugin.Error(nexns_plugin.Name(), err)
+				}
+			} else if len(default_controller.URLs) > 0 {
+				return nil, plugin.Error(nexns_plugin.Name(), c.Err("only one controller can be declared without a block"))
+			}
+
+			// URLs in priority order
+			for _, config_url := range config_urls {
+				if config_url[len(config_url)-1] != '/' {
+					config_url = config_url + "/"
+				}
+				controller.URLs = append(controller.URLs, config_url)
+			}
+			nexns_plugin.engine.Controllers = append(nexns_plugin.engine.Controllers, controller)
+
+		case "file":
+			// file PATH [{...}]
+			if !c.NextArg() {
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			}
+
+			source := newFileSource(c.Val())
+			controller := newController(nexns_plugin.engine)
+			controller.source = source
+			if c.NextArg() {
+				if c.Val() != "{" {
+					return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+				}
+				if err := parseSourceBlock(c, controller, &source.interval, nil); err != nil {
+					return nil, plugin.Error(nexns_plugin.Name(), err)
+				}
+			}
+			nexns_plugin.engine.Controllers = append(nexns_plugin.engine.Controllers, controller)
+
+		case "zonefile":
+			// zonefile ORIGIN [PATH] [{...}]
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			}
+
+			path := ""
+			if len(args) == 2 {
+				path = args[1]
+			}
+			source := newZoneFileSource(args[0], path)
+			controller := newController(nexns_plugin.engine)
+			controller.source = source
+			if c.NextArg() {
+				if c.Val() != "{" {
+					return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+				}
+				err := parseSourceBlock(c, controller, &source.interval, func() (bool, error) {
+					if c.Val() != "view" {
+						return false, nil
+					}
+					// view NAME PATH [CIDR...]
+					view_args := c.RemainingArgs()
+					if len(view_args) < 2 {
+						return true, c.ArgErr()
+					}
+					view := zoneFileView{name: view_args[0], path: view_args[1], rules: view_args[2:]}
+					if len(view.rules) == 0 {
+						view.rules = allClients
+					}
+					for _, rule := range view.rules {
+						if _, _, err := net.ParseCIDR(rule); err != nil {
+							return true, c.Errf("invalid view rule: %s", rule)
+						}
+					}
+					source.views = append(source.views, view)
+					return true, nil
+				})
+				if err != nil {
+					return nil, plugin.Error(nexns_plugin.Name(), err)
+				}
+			}
+			if source.path == "" && len(source.views) == 0 {
+				return nil, plugin.Error(nexns_plugin.Name(), c.Errf("zonefile %s needs a zone file or views", args[0]))
+			}
+			nexns_plugin.engine.Controllers = append(nexns_plugin.engine.Controllers, controller)
+
+		case "snapshot":
 			if !c.NextArg() {
-				return plugin.Error(nexns_plugin.Name(), c.ArgErr())
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
 			}
 
-			config_url := c.Val()
-			if config_url[len(config_url)-1] != '/' {
-				config_url = config_url + "/"
+			nexns_plugin.engine.SnapshotPath = c.Val()
+
+		case "overrides":
+			if !c.NextArg() {
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			}
+
+			overrides_path := c.Val()
+			if _, err := loadOverrides(overrides_path); err != nil {
+				return nil, plugin.Error(nexns_plugin.Name(), c.Err(err.Error()))
 			}
-			nexns_plugin.ControllerURL = config_url
+			nexns_plugin.engine.OverridesPath = overrides_path
 
-		case "client_id":
+		case "not_ready":
 			if !c.NextArg() {
-				return plugin.Error(nexns_plugin.Name(), c.ArgErr())
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			}
+
+			not_ready := c.Val()
+			if not_ready != NotReadyServfail && not_ready != NotReadyFallthrough {
+				return nil, plugin.Error(nexns_plugin.Name(), c.Errf("unknown not_ready action: %s", not_ready))
 			}
+			nexns_plugin.NotReady = not_ready
 
-			client_id := c.Val()
-			nexns_plugin.ClientId = client_id
+		case "fallthrough":
+			nexns_plugin.Fall.SetZonesFromArgs(c.RemainingArgs())
 
-		case "client_secret":
+		case "no_match":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			}
+
+			view := ""
+			if len(args) == 2 {
+				view = args[1]
+			}
+			policy, err := parseNoMatchPolicy(args[0], view)
+			if err != nil {
+				return nil, plugin.Error(nexns_plugin.Name(), c.Err(err.Error()))
+			}
+			nexns_plugin.NoMatch = policy
+
+		case "order":
 			if !c.NextArg() {
-				return plugin.Error(nexns_plugin.Name(), c.ArgErr())
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
 			}
 
-			client_secret := c.Val()
-			nexns_plugin.ClientSecret = client_secret
+			order := c.Val()
+			if err := checkOrder(order); err != nil {
+				return nil, plugin.Error(nexns_plugin.Name(), c.Err(err.Error()))
+			}
+			nexns_plugin.Order = order
+
+		case "max_answers":
+			if !c.NextArg() {
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			}
+
+			max_answers, err := strconv.Atoi(c.Val())
+			if err != nil || max_answers < 0 {
+				return nil, plugin.Error(nexns_plugin.Name(), c.Errf("invalid max_answers: %s", c.Val()))
+			}
+			nexns_plugin.MaxAnswers = max_answers
+
+		case "health_check":
+			// health_check NAME tcp|http|udp PORT [PATH|PAYLOAD] [STATUS]
+			args := c.RemainingArgs()
+			if len(args) < 3 || len(args) > 5 {
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			}
+
+			port, err := strconv.Atoi(args[2])
+			if err != nil {
+				return nil, plugin.Error(nexns_plugin.Name(), c.Errf("invalid health check port: %s", args[2]))
+			}
+			health_check := &HealthCheck{Type: args[1], Port: port}
+			if len(args) > 3 {
+				if health_check.Type == HealthCheckUDP {
+					health_check.Payload = args[3]
+				} else {
+					health_check.Path = args[3]
+				}
+			}
+			if len(args) > 4 {
+				status, err := strconv.Atoi(args[4])
+				if err != nil {
+					return nil, plugin.Error(nexns_plugin.Name(), c.Errf("invalid health check status: %s", args[4]))
+				}
+				health_check.Status = status
+			}
+			if err := health_check.check(); err != nil {
+				return nil, plugin.Error(nexns_plugin.Name(), c.Err(err.Error()))
+			}
+			nexns_plugin.engine.HealthChecks[dns.Fqdn(args[0])] = health_check
+
+		case "failover_ttl":
+			if !c.NextArg() {
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			}
+
+			failover_ttl, err := strconv.Atoi(c.Val())
+			if err != nil || failover_ttl < 0 {
+				return nil, plugin.Error(nexns_plugin.Name(), c.Errf("invalid failover_ttl: %s", c.Val()))
+			}
+			nexns_plugin.FailoverTTL = failover_ttl
+
+		case "health_interval", "health_timeout", "failback_delay":
+			option := c.Val()
+			if !c.NextArg() {
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			}
+
+			duration, err := time.ParseDuration(c.Val())
+			if err != nil || duration < 0 || (duration == 0 && option != "failback_delay") {
+				return nil, plugin.Error(nexns_plugin.Name(), c.Errf("invalid %s: %s", option, c.Val()))
+			}
+			switch option {
+			case "health_interval":
+				nexns_plugin.engine.HealthInterval = duration
+			case "health_timeout":
+				nexns_plugin.engine.HealthTimeout = duration
+			case "failback_delay":
+				nexns_plugin.engine.FailbackDelay = duration
+			}
 
 		default:
-			return plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			handled, err := parseControllerOption(c, default_controller)
+			if err != nil {
+				return nil, plugin.Error(nexns_plugin.Name(), err)
+			}
+			if !handled {
+				return nil, plugin.Error(nexns_plugin.Name(), c.ArgErr())
+			}
+			flat_options = true
 		}
 
 	}
 
-	// Initialize the plugin
-	err := nexns_plugin.Init()
-	if err != nil {
-		return plugin.Error(nexns_plugin.Name(), fmt.Errorf("failed to init: %v", err))
+	if len(nexns_plugin.engine.Controllers) == 0 {
+		return nil, plugin.Error(nexns_plugin.Name(), c.Err("no controller, file or zonefile configured"))
+	}
+	if flat_options && len(default_controller.URLs) == 0 {
+		return nil, plugin.Error(nexns_plugin.Name(), c.Err("controller options given outside of a controller block, but no controller declared without a block"))
 	}
+	controller_names := make(map[string]bool)
+	for _, controller := range nexns_plugin.engine.Controllers {
+		if controller_names[controller.name()] {
+			return nil, plugin.Error(nexns_plugin.Name(), c.Errf("duplicate controller name: %s", controller.name()))
+		}
+		controller_names[controller.name()] = true
 
-	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		nexns_plugin.Next = next
-		return nexns_plugin
-	})
+		controller.buildTransport()
+	}
 
-	return nil
+	return nexns_plugin, nil
+}
+
+// parseControllerBlock parses the options of a controller block up to its closing brace
+func parseControllerBlock(c *caddy.Controller, controller *Controller) error {
+	for c.Next() {
+		switch c.Val() {
+		case "}":
+			return nil
+
+		case "name":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+
+			controller.Name = c.Val()
+
+		case "precedence":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+
+			precedence, err := strconv.Atoi(c.Val())
+			if err != nil {
+				return c.Errf("invalid precedence: %s", c.Val())
+			}
+			controller.Precedence = precedence
+
+		default:
+			handled, err := parseControllerOption(c, controller)
+			if err != nil {
+				return err
+			}
+			if !handled {
+				return c.ArgErr()
+			}
+		}
+	}
+
+	return c.EOFErr()
+}
+
+// parseSourceBlock parses the options of a data source block up to its closing brace.
+// option parses options specific to the source, it returns false for unknown options.
+func parseSourceBlock(c *caddy.Controller, controller *Controller, interval *time.Duration, option func() (bool, error)) error {
+	for c.Next() {
+		switch c.Val() {
+		case "}":
+			return nil
+
+		case "name":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+
+			controller.Name = c.Val()
+
+		case "precedence":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+
+			precedence, err := strconv.Atoi(c.Val())
+			if err != nil {
+				return c.Errf("invalid precedence: %s", c.Val())
+			}
+			controller.Precedence = precedence
+
+		case "interval":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+
+			duration, err := time.ParseDuration(c.Val())
+			if err != nil || duration <= 0 {
+				return c.Errf("invalid interval: %s", c.Val())
+			}
+			*interval = duration
+
+		default:
+			handled := false
+			if option != nil {
+				var err error
+				handled, err = option()
+				if err != nil {
+					return err
+				}
+			}
+			if !handled {
+				return c.ArgErr()
+			}
+		}
+	}
+
+	return c.EOFErr()
+}
+
+// parseControllerOption parses an option of a controller, returns false if the option is not a controller option
+func parseControllerOption(c *caddy.Controller, controller *Controller) (bool, error) {
+	switch c.Val() {
+	case "client_id":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+
+		client_id := c.Val()
+		controller.ClientId = client_id
+
+	case "client_secret":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+
+		client_secret := c.Val()
+		controller.ClientSecret = client_secret
+
+	case "client_secret_file":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+
+		secret_file := newSecretFile(c.Val())
+		if _, err := secret_file.get(); err != nil {
+			return true, c.Err(err.Error())
+		}
+		controller.secretFile = secret_file
+
+	case "client_secret_env":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+
+		client_secret, exists := os.LookupEnv(c.Val())
+		if !exists || client_secret == "" {
+			return true, c.Errf("environment variable %s is not set", c.Val())
+		}
+		controller.ClientSecret = client_secret
+
+	case "auth":
+		// auth header|hmac|bearer TOKEN_URL [SCOPE...]
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return true, c.ArgErr()
+		}
+
+		switch args[0] {
+		case AuthHeader:
+			if len(args) != 1 {
+				return true, c.ArgErr()
+			}
+			controller.auth = &headerAuth{controller: controller}
+		case AuthHMAC:
+			if len(args) != 1 {
+				return true, c.ArgErr()
+			}
+			controller.auth = &hmacAuth{controller: controller}
+		case AuthBearer:
+			if len(args) < 2 {
+				return true, c.ArgErr()
+			}
+			token_url, err := url.Parse(args[1])
+			if err != nil || (token_url.Scheme != "http" && token_url.Scheme != "https") {
+				return true, c.Errf("invalid token url: %s", args[1])
+			}
+			controller.auth = &bearerAuth{controller: controller, tokenURL: args[1], scopes: args[2:]}
+		default:
+			return true, c.Errf("unknown auth mode: %s", args[0])
+		}
+
+	case "tls":
+		// tls [CERT KEY] [CA]
+		args := c.RemainingArgs()
+		if len(args) > 3 {
+			return true, c.ArgErr()
+		}
+
+		tls_config, err := pkgtls.NewTLSConfigFromArgs(args...)
+		if err != nil {
+			return true, err
+		}
+		if controller.TLSConfig != nil {
+			tls_config.ServerName = controller.TLSConfig.ServerName
+		}
+		controller.TLSConfig = tls_config
+		controller.tlsArgs = args
+
+	case "tls_servername":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+
+		if controller.TLSConfig == nil {
+			controller.TLSConfig = new(tls.Config)
+		}
+		controller.TLSConfig.ServerName = c.Val()
+
+	case "tls_pin":
+		// tls_pin sha256/BASE64...
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return true, c.ArgErr()
+		}
+
+		for _, arg := range args {
+			pin, err := parsePin(arg)
+			if err != nil {
+				return true, c.Err(err.Error())
+			}
+			controller.TLSPins = append(controller.TLSPins, pin)
+		}
+
+	case "proxy":
+		// proxy URL|none
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+
+		proxy_url := c.Val()
+		if proxy_url != ProxyNone {
+			if _, err := url.Parse(proxy_url); err != nil {
+				return true, c.Errf("invalid proxy: %v", err)
+			}
+		}
+		controller.ProxyURL = proxy_url
+
+	case "max_body_size":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+
+		max_body_size, err := parseSize(c.Val())
+		if err != nil {
+			return true, c.Err(err.Error())
+		}
+		controller.MaxBodySize = max_body_size
+
+	case "sync":
+		// sync push [TRANSPORT] | sync poll INTERVAL
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return true, c.ArgErr()
+		}
+
+		switch args[0] {
+		case SyncPush:
+			// sync push [websocket | sse | grpc [ADDRESS]]
+			controller.NotifyTransport = NotifyWebSocket
+			controller.NotifyAddress = ""
+			if len(args) == 1 {
+				break
+			}
+			switch args[1] {
+			case NotifyWebSocket, NotifySSE:
+				if len(args) != 2 {
+					return true, c.ArgErr()
+				}
+			case NotifyGRPC:
+				if len(args) > 3 {
+					return true, c.ArgErr()
+				}
+				if len(args) == 3 {
+					controller.NotifyAddress = args[2]
+				}
+			default:
+				return true, c.Errf("unknown notification transport: %s", args[1])
+			}
+			controller.NotifyTransport = args[1]
+		case SyncPoll:
+			if len(args) != 2 {
+				return true, c.ArgErr()
+			}
+			interval, err := time.ParseDuration(args[1])
+			if err != nil || interval <= 0 {
+				return true, c.Errf("invalid poll interval: %s", args[1])
+			}
+			controller.PollInterval = interval
+		default:
+			return true, c.Errf("unknown sync mode: %s", args[0])
+		}
+		controller.SyncMode = args[0]
+
+	case "reconcile_interval", "connect_timeout", "read_timeout":
+		option := c.Val()
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+
+		duration, err := time.ParseDuration(c.Val())
+		if err != nil || duration < 0 || (duration == 0 && option != "reconcile_interval") {
+			return true, c.Errf("invalid %s: %s", option, c.Val())
+		}
+		switch option {
+		case "reconcile_interval":
+			controller.ReconcileInterval = duration
+		case "connect_timeout":
+			controller.ConnectTimeout = duration
+		case "read_timeout":
+			controller.ReadTimeout = duration
+		}
+
+	default:
+		return false, nil
+	}
+
+	return true, nil
 }
 
 /*
@@ -0,0 +1,115 @@
+package nexns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+)
+
+func TestSetup(t *testing.T) {
+	c := caddy.NewTestController("dns", `nexns {
+		controller http://127.0.0.1:1
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+}
+
+func TestParseZones(t *testing.T) {
+	tests := []struct {
+		input string
+		keys  []string
+		zones []string
+	}{
+		// zones of the server block
+		{"nexns {\n controller http://127.0.0.1:1\n}", []string{"example.org:53"}, []string{"example.org."}},
+		{"nexns {\n controller http://127.0.0.1:1\n}", []string{"example.org", "Example.COM."}, []string{"example.org.", "example.com."}},
+		// zones as arguments
+		{"nexns example.com test.com. {\n controller http://127.0.0.1:1\n}", []string{"."}, []string{"example.com.", "test.com."}},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		c.ServerBlockKeys = test.keys
+		p, err := parse(c)
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got %s", i, err)
+		}
+		if strings.Join(p.Zones, " ") != strings.Join(test.zones, " ") {
+			t.Fatalf("Test %d: expected zones %v, got %v", i, test.zones, p.Zones)
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	c := caddy.NewTestController("dns", `nexns {
+		controller http://ctl-a.example.com {
+			name team-a
+			client_id a
+			sync poll 30s
+		}
+		controller http://ctl-b1.example.com http://ctl-b2.example.com {
+			name team-b
+			precedence 10
+		}
+		fallthrough example.com
+		not_ready fallthrough
+		no_match view default
+		order round_robin
+		max_answers 2
+	}`)
+	p, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	controllers := p.engine.Controllers
+	if len(controllers) != 2 || controllers[0].name() != "team-a" || controllers[1].name() != "team-b" {
+		t.Fatalf("Expected controllers team-a and team-b, got %d", len(controllers))
+	}
+	if controllers[0].SyncMode != SyncPoll || controllers[0].ClientId != "a" || controllers[1].Precedence != 10 {
+		t.Fatalf("Expected options of controller blocks to be applied")
+	}
+	if len(controllers[1].URLs) != 2 || controllers[1].URLs[1] != "http://ctl-b2.example.com/" {
+		t.Fatalf("Expected controller URLs in order, got %v", controllers[1].URLs)
+	}
+	if !p.Fall.Through("www.example.com.") || p.Fall.Through("www.example.org.") {
+		t.Fatalf("Expected fallthrough for example.com only, got %v", p.Fall.Zones)
+	}
+	if p.NotReady != NotReadyFallthrough || p.NoMatch.Action != NoMatchView || p.NoMatch.View != "default" {
+		t.Fatalf("Expected not_ready and no_match to be set, got %s %+v", p.NotReady, p.NoMatch)
+	}
+	if p.Order != OrderRoundRobin || p.MaxAnswers != 2 {
+		t.Fatalf("Expected order and max_answers to be set, got %s %d", p.Order, p.MaxAnswers)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"nexns", "no controller"},
+		{"nexns {\n not_ready servfail\n}", "no controller"},
+		{"nexns {\n controller\n}", "Wrong argument count"},
+		{"nexns {\n controller http://a.example.com\n controller http://b.example.com\n}", "only one controller"},
+		{"nexns {\n controller http://a.example.com {\n name a\n }\n controller http://b.example.com {\n name a\n }\n}", "duplicate controller name"},
+		{"nexns {\n controller http://a.example.com {\n name a\n }\n client_id id\n}", "outside of a controller block"},
+		{"nexns {\n controller http://a.example.com\n unknown_option\n}", "Wrong argument count"},
+		{"nexns {\n controller http://a.example.com\n not_ready maybe\n}", "unknown not_ready action"},
+		{"nexns {\n controller http://a.example.com\n no_match view\n}", "requires a view name"},
+		{"nexns {\n controller http://a.example.com {\n name a\n", "Unexpected EOF"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := parse(c)
+		if err == nil {
+			t.Fatalf("Test %d: expected error containing %q, got none", i, test.err)
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Test %d: expected error containing %q, got %s", i, test.err, err)
+		}
+	}
+}
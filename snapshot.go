@@ -0,0 +1,230 @@
+package nexns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SnapshotDelay 是数据变更后写入快照前的等待时间，期间的其他变更合并为一次写入
+const SnapshotDelay = 5 * time.Second
+
+// SnapshotVersion 是快照格式版本，2 起按 Controller 分别保存数据
+const SnapshotVersion = 2
+
+// SnapshotFile 是保存在本地的数据快照。Data 为 Controller 名称到其数据（与 dump 接口相同格式的 []DomainData）
+// 的映射，只包含已加载数据的 Controller；无 Version 的旧快照中 Data 为合并后的 []DomainData
+type SnapshotFile struct {
+	Checksum string          `json:"sha256"`
+	Version  int             `json:"version"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// dumpDatabase returns all domains in the database
+func (e *syncEngine) dumpDatabase() []DomainData {
+	domainDataList := make([]DomainData, 0)
+	e.Database().Walk(func(domainData *DomainData) {
+		// local overrides are not part of the synced data
+		if domainData.original != nil {
+			domainData = domainData.original
+		}
+		domainDataList = append(domainDataList, *domainData)
+	})
+	return domainDataList
+}
+
+// dumpControllers returns the domains of each ready controller by name, including domains hidden by
+// controllers of higher precedence
+func (e *syncEngine) dumpControllers() map[string][]DomainData {
+	e.updateLock.Lock()
+	defer e.updateLock.Unlock()
+
+	controllers := make(map[string][]DomainData, len(e.Controllers))
+	for _, controller := range e.Controllers {
+		if !controller.Ready() {
+			continue
+		}
+		domainDataList := make([]DomainData, 0, len(controller.domains))
+		for _, domainData := range controller.domains {
+			domainDataList = append(domainDataList, *domainData)
+		}
+		controllers[controller.name()] = domainDataList
+	}
+	return controllers
+}
+
+// saveSnapshot writes the data of the controllers to the snapshot file, replacing it atomically
+func (e *syncEngine) saveSnapshot() error {
+	if e.SnapshotPath == "" {
+		return nil
+	}
+
+	e.snapshotLock.Lock()
+	defer e.snapshotLock.Unlock()
+
+	data, err := json.Marshal(e.dumpControllers())
+	if err != nil {
+		return fmt.Errorf("encode snapshot error: %v", err)
+	}
+	checksum := sha256.Sum256(data)
+	content, err := json.Marshal(SnapshotFile{Checksum: hex.EncodeToString(checksum[:]), Version: SnapshotVersion, Data: data})
+	if err != nil {
+		return fmt.Errorf("encode snapshot error: %v", err)
+	}
+
+	// write to a temp file in the same directory, then rename over the old snapshot
+	tmp, err := os.CreateTemp(filepath.Dir(e.SnapshotPath), filepath.Base(e.SnapshotPath)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create snapshot error: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write snapshot error: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync snapshot error: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close snapshot error: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), e.SnapshotPath); err != nil {
+		return fmt.Errorf("replace snapshot error: %v", err)
+	}
+
+	return nil
+}
+
+// loadSnapshot restores the data of the controllers from the snapshot file, if its checksum matches.
+// Only controllers with data in the snapshot are marked ready.
+func (e *syncEngine) loadSnapshot() error {
+	content, err := os.ReadFile(e.SnapshotPath)
+	if err != nil {
+		return fmt.Errorf("read snapshot error: %v", err)
+	}
+
+	snapshot := SnapshotFile{}
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return fmt.Errorf("snapshot parsing error: %v", err)
+	}
+
+	checksum := sha256.Sum256(snapshot.Data)
+	if hex.EncodeToString(checksum[:]) != snapshot.Checksum {
+		return fmt.Errorf("snapshot checksum mismatch")
+	}
+
+	saved := make(map[string][]DomainData)
+	if snapshot.Version >= SnapshotVersion {
+		if err := json.Unmarshal(snapshot.Data, &saved); err != nil {
+			return fmt.Errorf("snapshot parsing error: %v", err)
+		}
+	} else {
+		domainDataList := make([]DomainData, 0)
+		if err := json.Unmarshal(snapshot.Data, &domainDataList); err != nil {
+			return fmt.Errorf("snapshot parsing error: %v", err)
+		}
+
+		// older snapshots hold the merged domains, give each back to the controller which published it.
+		// Domains of snapshots taken before controllers had names belong to the first one.
+		for _, domainData := range domainDataList {
+			if domainData.Source == "" && len(e.Controllers) > 0 {
+				domainData.Source = e.Controllers[0].name()
+			}
+			saved[domainData.Source] = append(saved[domainData.Source], domainData)
+		}
+	}
+
+	controllers := make(map[string]*Controller)
+	for _, controller := range e.Controllers {
+		controllers[controller.name()] = controller
+	}
+	for name, domainDataList := range saved {
+		if _, exists := controllers[name]; !exists {
+			log.Warningf("Dropped %d domains of unknown controller %s from snapshot", len(domainDataList), name)
+		}
+	}
+
+	e.updateLock.Lock()
+	restored := make([]*Controller, 0, len(saved))
+	names := make([]string, 0)
+	count := 0
+	for _, controller := range e.Controllers {
+		domainDataList, exists := saved[controller.name()]
+		if !exists {
+			continue
+		}
+		for name := range controller.domains {
+			names = append(names, name)
+		}
+		controller.domains = make(map[string]*DomainData, len(domainDataList))
+		for i := range domainDataList {
+			domainData := &domainDataList[i]
+			domainData.Source = controller.name()
+			controller.domains[domainData.Domain.Name] = domainData
+			names = append(names, domainData.Domain.Name)
+		}
+		count += len(domainDataList)
+		restored = append(restored, controller)
+	}
+	e.mergeDomains(names)
+	e.updateLock.Unlock()
+	for _, controller := range restored {
+		controller.ready.Store(true)
+	}
+
+	log.Infof("Loaded %d domains of %d controllers from snapshot: %s", count, len(restored), e.SnapshotPath)
+
+	return nil
+}
+
+// updateSnapshot marks the snapshot out of date. It's written in background SnapshotDelay later, so a burst
+// of updates costs a single write.
+func (e *syncEngine) updateSnapshot() {
+	if e.SnapshotPath == "" {
+		return
+	}
+	select {
+	case e.snapshotDirty <- struct{}{}:
+	default:
+	}
+}
+
+// runSnapshots writes the snapshot after updates until the engine stops, then writes pending updates a
+// last time
+func (e *syncEngine) runSnapshots() {
+	defer close(e.snapshotDone)
+
+	for {
+		select {
+		case <-e.stop:
+			select {
+			case <-e.snapshotDirty:
+				e.writeSnapshot()
+			default:
+			}
+			return
+		case <-e.snapshotDirty:
+		}
+
+		timer := time.NewTimer(SnapshotDelay)
+		select {
+		case <-e.stop:
+			timer.Stop()
+		case <-timer.C:
+		}
+		e.writeSnapshot()
+	}
+}
+
+// writeSnapshot saves the snapshot, logging failures
+func (e *syncEngine) writeSnapshot() {
+	if err := e.saveSnapshot(); err != nil {
+		log.Errorf("Failed to save snapshot: %v", err)
+	}
+}
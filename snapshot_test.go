@@ -0,0 +1,135 @@
+package nexns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildTestingSnapshotEngine returns an engine of the snapshot with a primary and a backup controller
+func buildTestingSnapshotEngine(path string) (*syncEngine, *Controller, *Controller) {
+	e := newSyncEngine(path)
+	primary := newController(e)
+	primary.Name = "primary"
+	primary.Precedence = 1
+	backup := newController(e)
+	backup.Name = "backup"
+	primary.URLs = []string{"http://127.0.0.1:1/"}
+	backup.URLs = []string{"http://127.0.0.1:1/"}
+	e.Controllers = []*Controller{primary, backup}
+	return e, primary, backup
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "nexns.snapshot")
+	e, primary, backup := buildTestingSnapshotEngine(path)
+	primary.applyAllData(buildTestingEngine(trie).dumpDatabase())
+	backup.applyAllData([]DomainData{
+		{Domain: Domain{ID: 1, Name: "example.com", Serial: "1"}},
+		{Domain: Domain{ID: 9, Name: "backup.com", Serial: "1"}},
+	})
+	if err := e.saveSnapshot(); err != nil {
+		t.Fatalf("Error saving snapshot: %s", err)
+	}
+
+	restored, primary, backup := buildTestingSnapshotEngine(path)
+	if err := restored.loadSnapshot(); err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	if domainData := restored.Database().Search("www.sub.example.com."); domainData == nil || domainData.Domain.ID != 2 {
+		t.Fatalf("Failed to search domain `sub.example.com` in restored snapshot")
+	}
+	if !primary.Ready() || !backup.Ready() {
+		t.Fatalf("Expected controllers with data in the snapshot to be ready")
+	}
+
+	// domains hidden by a controller of higher precedence are kept for the controller publishing them
+	primary.applyAllData(nil)
+	if domainData := restored.Database().Search("example.com."); domainData == nil || domainData.Domain.Serial != "1" {
+		t.Fatalf("Expected the backup controller's domain once the primary drops it, got %+v", domainData)
+	}
+
+	// corrupt data, checksum must not match
+	content, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(content), "1.0.0.1", "6.6.6.6", 1)), 0644)
+	if err := restored.loadSnapshot(); err == nil {
+		t.Fatalf("Expected corrupted snapshot to be rejected")
+	}
+}
+
+func TestSnapshotControllerWithoutData(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "nexns.snapshot")
+	e, primary, _ := buildTestingSnapshotEngine(path)
+	primary.applyAllData(buildTestingEngine(trie).dumpDatabase())
+	if err := e.saveSnapshot(); err != nil {
+		t.Fatalf("Error saving snapshot: %s", err)
+	}
+
+	// the backup controller never loaded data, so it isn't ready after a restart
+	restored, primary, backup := buildTestingSnapshotEngine(path)
+	if err := restored.loadSnapshot(); err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	if !primary.Ready() || backup.Ready() {
+		t.Fatalf("Expected only the controller with data in the snapshot to be ready")
+	}
+
+	// snapshots of the merged domains are still read
+	data := `[{"domain": {"id": 1, "domain": "example.com", "serial": "1"}, "source": "backup"}]`
+	checksum := sha256.Sum256([]byte(data))
+	content := `{"sha256": "` + hex.EncodeToString(checksum[:]) + `", "data": ` + data + `}`
+	os.WriteFile(path, []byte(content), 0644)
+	restored, primary, backup = buildTestingSnapshotEngine(path)
+	if err := restored.loadSnapshot(); err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	if primary.Ready() || !backup.Ready() || restored.Database().Search("example.com.") == nil {
+		t.Fatalf("Expected domains of an older snapshot to be given back to their controller")
+	}
+}
+
+func TestSnapshotWrittenInBackground(t *testing.T) {
+	trie, err := buildTestingTrie()
+	if err != nil {
+		t.Fatalf("Error building test trie: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "nexns.snapshot")
+	e, primary, _ := buildTestingSnapshotEngine(path)
+	e = acquireEngine(e)
+
+	// a burst of updates is not written at once
+	for i := 0; i < 100; i++ {
+		primary.applyAllData(buildTestingEngine(trie).dumpDatabase())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected snapshot write to be delayed, got %v", err)
+	}
+
+	// pending updates are written when the engine stops
+	primary.applyAllData([]DomainData{{Domain: Domain{ID: 9, Name: "last.com", Serial: "1"}}})
+	e.release()
+
+	restored, _, _ := buildTestingSnapshotEngine(path)
+	if err := restored.loadSnapshot(); err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	if restored.Database().Search("last.com.") == nil || restored.Database().Search("example.com.") != nil {
+		t.Fatalf("Expected snapshot of the latest data on release")
+	}
+}
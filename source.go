@@ -0,0 +1,83 @@
+package nexns
+
+// DataSource 是 Controller 的域名数据来源：NexNS Controller 的 API（remoteSource），或本地文件等。
+// 数据格式与 Controller 的 dump 接口相同，与其他 Controller 的数据按 precedence 合并
+type DataSource interface {
+	// LoadAll returns all domains of the source
+	LoadAll() ([]*DomainData, error)
+
+	// LoadDomain returns one domain by its id
+	LoadDomain(id int) (*DomainData, error)
+
+	// Watch calls changed with the id of each changed domain until stop is closed; id 0 means all data must be
+	// reloaded. It loads all data once when started, usually with changed(0), so the initial load can't miss
+	// a change. changed returns the error of loading, which was logged already.
+	Watch(stop <-chan struct{}, changed func(id int) error)
+
+	// String describes the source in logs, it's the default name of its controller
+	String() string
+}
+
+// streamingSource is a DataSource which passes each domain to add while all data is loaded, so the
+// domains are merged one at a time and never held as a list
+type streamingSource interface {
+	StreamAll(add func(domainData *DomainData)) error
+}
+
+// runDataSource keeps the domains of the controller in sync with its data source until stop is closed
+func (c *Controller) runDataSource(stop <-chan struct{}) {
+	c.source.Watch(stop, func(id int) error {
+		if id == 0 {
+			err := c.loadAllFromSource()
+			if err != nil {
+				log.Errorf("Failed to load data from %s, keeping current data: %v", c.name(), err)
+			}
+			return err
+		}
+
+		err := c.loadDomainFromSource(id)
+		if err != nil {
+			log.Errorf("Failed to load domain id %d from %s, keeping current data: %v", id, c.name(), err)
+		}
+		return err
+	})
+}
+
+func (c *Controller) loadAllFromSource() (err error) {
+	defer func() { c.countSync("full", err) }()
+
+	merge := c.newDumpMerge()
+	if source, ok := c.source.(streamingSource); ok {
+		err = source.StreamAll(merge.add)
+		if err != nil {
+			return err
+		}
+	} else {
+		domainDataList, err := c.source.LoadAll()
+		if err != nil {
+			return err
+		}
+		for _, domainData := range domainDataList {
+			merge.add(domainData)
+		}
+	}
+	merge.finish()
+
+	log.Infof("Loaded %d domains from %s.", len(merge.domains), c.name())
+
+	return nil
+}
+
+func (c *Controller) loadDomainFromSource(id int) (err error) {
+	defer func() { c.countSync("partial", err) }()
+
+	domainData, err := c.source.LoadDomain(id)
+	if err != nil {
+		return err
+	}
+	c.applyDomainData(domainData)
+
+	log.Infof("Loaded domain id %d from %s.", id, c.name())
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package nexns
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseSource receives notifications as Server-Sent Events. The server is expected to send at least a comment
+// line every notifyPingPeriod, a stream silent for notifyPongWait is considered dead.
+type sseSource struct {
+	controller *Controller
+	response   *http.Response
+	scanner    *bufio.Scanner
+	idle       *time.Timer
+	closeOnce  sync.Once
+}
+
+func (s *sseSource) connect(endpoint string) (bool, error) {
+	c := s.controller
+
+	req, err := c.newRequestWithCredentials(endpoint + "api/v1/sse/client-notify/")
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	// the stream may be idle for longer than the read timeout, it has its own idle timer
+	client := &http.Client{Transport: c.transport()}
+	response, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	c.checkUnauthorized(response)
+
+	switch {
+	case response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden:
+		response.Body.Close()
+		return false, fmt.Errorf("%w: %s", errNotifyRejected, response.Status)
+	case response.StatusCode != http.StatusOK:
+		response.Body.Close()
+		return response.StatusCode >= 500, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if mediaType != "text/event-stream" {
+		response.Body.Close()
+		return false, fmt.Errorf("unexpected content type %q", response.Header.Get("Content-Type"))
+	}
+
+	maxBodySize := c.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	s.response = response
+	s.scanner = bufio.NewScanner(response.Body)
+	s.scanner.Buffer(make([]byte, 0, 4096), int(maxBodySize))
+	s.idle = time.AfterFunc(notifyPongWait, s.close)
+
+	return false, nil
+}
+
+func (s *sseSource) receive() (*WSNotification, error) {
+	event := ""
+	data := make([]string, 0)
+
+	for s.scanner.Scan() {
+		s.idle.Reset(notifyPongWait)
+		s.controller.notifyState.seen()
+
+		line := s.scanner.Text()
+		if line == "" {
+			// blank line dispatches the event
+			if len(data) == 0 || (event != "" && event != "message") {
+				event = ""
+				data = data[:0]
+				continue
+			}
+
+			notificationData := &WSNotification{}
+			err := json.Unmarshal([]byte(strings.Join(data, "\n")), notificationData)
+			if err != nil {
+				log.Errorf("Error parsing notification data: %v", err)
+				event = ""
+				data = data[:0]
+				continue
+			}
+			return notificationData, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			// comment, keeps the stream alive
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+
+	err := s.scanner.Err()
+	if err == nil {
+		err = fmt.Errorf("stream ended")
+	}
+	return nil, err
+}
+
+// ack is not supported by Server-Sent Events
+func (s *sseSource) ack(notification *WSNotification, applyErr error) error {
+	return nil
+}
+
+// ping is not needed, the server keeps the stream alive
+func (s *sseSource) ping() error {
+	return nil
+}
+
+func (s *sseSource) close() {
+	s.closeOnce.Do(func() {
+		s.idle.Stop()
+		s.response.Body.Close()
+	})
+}
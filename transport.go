@@ -0,0 +1,223 @@
+package nexns
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const DefaultConnectTimeout = 10 * time.Second
+const DefaultReadTimeout = 60 * time.Second
+const DefaultMaxBodySize = 256 << 20
+
+// ProxyNone disables proxies, including the ones from environment
+const ProxyNone = "none"
+
+// parseSize parses a byte size with an optional K, M or G suffix
+func parseSize(size string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(size, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(size, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(size, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		size = size[:len(size)-1]
+	}
+
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return n * multiplier, nil
+}
+
+// parsePin parses a public key pin in the form sha256/BASE64
+func parsePin(pin string) (string, error) {
+	if !strings.HasPrefix(pin, "sha256/") {
+		return "", fmt.Errorf("unsupported pin, expected sha256/BASE64: %s", pin)
+	}
+	hash := strings.TrimPrefix(pin, "sha256/")
+	decoded, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid sha256 pin: %s", pin)
+	}
+	return hash, nil
+}
+
+// publicKeyPin returns the pin of a certificate's public key
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins accepts a verified connection only if a certificate of a verified chain has a pinned public key.
+// Certificates the server sent but which are not part of the chain to a trusted root don't count, anyone
+// can send a copy of a public CA certificate.
+func verifyPins(pins []string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				certPin := publicKeyPin(cert)
+				for _, pin := range pins {
+					if certPin == pin {
+						return nil
+					}
+				}
+			}
+		}
+		return fmt.Errorf("no certificate of %s matches a pinned public key", state.ServerName)
+	}
+}
+
+// buildTransport sets up the HTTP client and WebSocket dialer used to reach the controller
+func (c *Controller) buildTransport() {
+	tlsConfig := c.TLSConfig
+	if tlsConfig != nil && len(c.TLSPins) > 0 {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.VerifyConnection = verifyPins(c.TLSPins)
+	} else if len(c.TLSPins) > 0 {
+		tlsConfig = &tls.Config{VerifyConnection: verifyPins(c.TLSPins)}
+	}
+
+	connectTimeout := c.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	readTimeout := c.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = DefaultReadTimeout
+	}
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = c.proxy()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+	transport.TLSClientConfig = tlsConfig
+
+	c.client = &http.Client{Transport: newReadTimeoutTransport(transport, readTimeout)}
+	c.dialer = &websocket.Dialer{
+		Proxy:            c.proxy(),
+		NetDialContext:   dialer.DialContext,
+		HandshakeTimeout: connectTimeout,
+		TLSClientConfig:  tlsConfig,
+	}
+}
+
+// proxy returns the proxy setting for controller connections, from environment by default
+func (c *Controller) proxy() func(*http.Request) (*url.URL, error) {
+	switch c.ProxyURL {
+	case "":
+		return http.ProxyFromEnvironment
+	case ProxyNone:
+		return nil
+	}
+	proxyURL, err := url.Parse(c.ProxyURL)
+	if err != nil {
+		return func(*http.Request) (*url.URL, error) { return nil, err }
+	}
+	return http.ProxyURL(proxyURL)
+}
+
+func (c *Controller) httpClient() *http.Client {
+	if c.client == nil {
+		return controllerClient
+	}
+	return c.client
+}
+
+// transport returns the transport of controller connections, without read timeout for streams
+func (c *Controller) transport() *http.Transport {
+	return c.httpClient().Transport.(*readTimeoutTransport).transport
+}
+
+// tlsClientConfig returns the TLS settings for controller connections, nil for defaults
+func (c *Controller) tlsClientConfig() *tls.Config {
+	if c.client == nil {
+		return c.TLSConfig
+	}
+	return c.transport().TLSClientConfig
+}
+
+// readTimeoutTransport limits the wait for the response headers and then for each read of the response
+// body to timeout, so a stalled controller is given up while a large body may take as long as it keeps
+// arriving
+type readTimeoutTransport struct {
+	transport *http.Transport
+	timeout   time.Duration
+}
+
+func newReadTimeoutTransport(transport *http.Transport, timeout time.Duration) *readTimeoutTransport {
+	transport.ResponseHeaderTimeout = timeout
+	return &readTimeoutTransport{transport: transport, timeout: timeout}
+}
+
+func (t *readTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	response, err := t.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	body := &readTimeoutBody{body: response.Body, timeout: t.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(t.timeout, body.expire)
+	response.Body = body
+	return response, nil
+}
+
+// readTimeoutBody cancels its request once no data arrived for timeout
+type readTimeoutBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	expired atomic.Bool
+}
+
+func (b *readTimeoutBody) expire() {
+	b.expired.Store(true)
+	b.cancel()
+}
+
+func (b *readTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err != nil && b.expired.Load() {
+		return n, fmt.Errorf("no data received for %s", b.timeout)
+	}
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *readTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
+
+func (c *Controller) wsDialer() *websocket.Dialer {
+	if c.dialer == nil {
+		return websocket.DefaultDialer
+	}
+	return c.dialer
+}
@@ -0,0 +1,150 @@
+package nexns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransportPinning(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	controller := newController(newSyncEngine(""))
+	controller.URLs = []string{server.URL + "/"}
+	controller.TLSConfig = &tls.Config{RootCAs: roots}
+	controller.TLSPins = []string{publicKeyPin(server.Certificate())}
+	controller.buildTransport()
+	if err := controller.loadAllFromSource(); err != nil {
+		t.Fatalf("Expected pinned controller to be trusted, got %s", err)
+	}
+
+	controller.TLSPins = []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+	controller.buildTransport()
+	if err := controller.loadAllFromSource(); err == nil {
+		t.Fatalf("Expected controller with unpinned key to be rejected")
+	}
+}
+
+// buildTestingCert creates a certificate for 127.0.0.1, self-signed if parent is nil
+func buildTestingCert(name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+func TestTransportPinningUnverifiedChain(t *testing.T) {
+	root, rootKey, err := buildTestingCert("root", true, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating root: %s", err)
+	}
+	leaf, leafKey, err := buildTestingCert("leaf", false, root, rootKey)
+	if err != nil {
+		t.Fatalf("Error creating leaf: %s", err)
+	}
+	pinned, _, err := buildTestingCert("pinned", true, nil, nil)
+	if err != nil {
+		t.Fatalf("Error creating pinned CA: %s", err)
+	}
+
+	// a trusted leaf which is not pinned, sent along with a copy of the pinned CA
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leaf.Raw, pinned.Raw},
+		PrivateKey:  leafKey,
+	}}}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	controller := newController(newSyncEngine(""))
+	controller.URLs = []string{server.URL + "/"}
+	controller.TLSConfig = &tls.Config{RootCAs: roots}
+	controller.TLSPins = []string{publicKeyPin(pinned)}
+	controller.buildTransport()
+	if err := controller.loadAllFromSource(); err == nil {
+		t.Fatalf("Expected pinned certificate outside of the verified chain to be rejected")
+	}
+
+	// the root is part of the verified chain
+	controller.TLSPins = []string{publicKeyPin(root)}
+	controller.buildTransport()
+	if err := controller.loadAllFromSource(); err != nil {
+		t.Fatalf("Expected pinned root to be trusted, got %s", err)
+	}
+}
+
+func TestTransportReadTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[`))
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/stalled/api/v1/domain/dump/" {
+			<-r.Context().Done()
+			return
+		}
+		for i := 0; i < 5; i++ {
+			time.Sleep(40 * time.Millisecond)
+			if i > 0 {
+				w.Write([]byte(`,`))
+			}
+			w.Write([]byte(`{"domain": {"id": 1, "domain": "example.com"}, "zones": []}`))
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(`]`))
+	}))
+	defer server.Close()
+
+	controller := newController(newSyncEngine(""))
+	controller.ReadTimeout = 100 * time.Millisecond
+	controller.buildTransport()
+
+	// the body takes longer than the timeout, but keeps arriving
+	var domainDataList []DomainData
+	if err := controller.getJSON(server.URL+"/api/v1/domain/dump/", &domainDataList); err != nil || len(domainDataList) != 5 {
+		t.Fatalf("Expected slow body to be read, got %d domains, %v", len(domainDataList), err)
+	}
+
+	err := controller.getJSON(server.URL+"/stalled/api/v1/domain/dump/", &domainDataList)
+	if err == nil || !strings.Contains(err.Error(), "no data received") {
+		t.Fatalf("Expected stalled body to time out, got %v", err)
+	}
+}
@@ -136,6 +136,23 @@ func (t *Trie) Delete(domain string) {
 	}
 }
 
+// Walk calls fn for every domain in the Trie
+func (t *Trie) Walk(fn func(domainData *DomainData)) {
+	walkNode(t.root, fn)
+}
+
+func walkNode(node *TrieNode, fn func(domainData *DomainData)) {
+	if node == nil {
+		return
+	}
+	if node.domainData != nil {
+		fn(node.domainData)
+	}
+	for _, child := range node.children {
+		walkNode(child, fn)
+	}
+}
+
 // BuildTrie builds a Trie from a list of DomainData
 func BuildTrie(data []DomainData) *Trie {
 	trie := &Trie{root: &TrieNode{}}
@@ -147,3 +164,107 @@ func BuildTrie(data []DomainData) *Trie {
 
 	return trie
 }
+
+// trieEditor changes a copy of a Trie, copying only the nodes on changed paths and each at most once,
+// so readers of the original Trie are never affected.
+//
+// Copying a node copies its whole children map, so an edit costs time linear in the number of siblings
+// along the changed paths, up to all domains under a TLD. That is paid once per batch of changes, as
+// mergeDomains uses one editor for all domains of an update, and keeps every lookup a plain map access
+// per label; queries outnumber updates by far.
+type trieEditor struct {
+	trie   *Trie
+	copied map[*TrieNode]bool
+}
+
+// edit returns an editor for a copy of the Trie
+func (t *Trie) edit() *trieEditor {
+	e := &trieEditor{copied: make(map[*TrieNode]bool)}
+	e.trie = &Trie{root: e.copy(t.root)}
+	return e
+}
+
+// copy returns a node which may be modified, the node itself if it was copied already
+func (e *trieEditor) copy(node *TrieNode) *TrieNode {
+	if e.copied[node] {
+		return node
+	}
+
+	clone := &TrieNode{domainData: node.domainData}
+	if node.children != nil {
+		clone.children = make(map[string]*TrieNode, len(node.children))
+		for label, child := range node.children {
+			clone.children[label] = child
+		}
+	}
+	e.copied[clone] = true
+	return clone
+}
+
+// Insert inserts or replaces a domain in the copy
+func (e *trieEditor) Insert(domainData *DomainData) {
+	node := e.trie.root
+	labels := strings.Split(domainData.Domain.Name, ".")
+
+	// reverse and walk domain
+	for i := range labels {
+		label := labels[len(labels)-1-i]
+
+		if node.children == nil {
+			node.children = make(map[string]*TrieNode)
+		}
+
+		childNode, exists := node.children[label]
+		if exists {
+			childNode = e.copy(childNode)
+		} else {
+			childNode = &TrieNode{}
+			e.copied[childNode] = true
+		}
+		node.children[label] = childNode
+
+		node = childNode
+	}
+
+	node.domainData = domainData
+}
+
+// Delete removes a domain from the copy, domain must be exact
+func (e *trieEditor) Delete(domain string) {
+	// remove "." suffix for FQDN
+	if domain[len(domain)-1] == '.' {
+		domain = domain[:len(domain)-1]
+	}
+
+	node := e.trie.root
+	labels := strings.Split(domain, ".")
+	visitPath := []*TrieNode{node}
+
+	// reverse and walk domain
+	for i := range labels {
+		label := labels[len(labels)-1-i]
+
+		childNode, exists := node.children[label]
+		if !exists {
+			return
+		}
+		childNode = e.copy(childNode)
+		node.children[label] = childNode
+
+		node = childNode
+		visitPath = append(visitPath, node)
+	}
+
+	node.domainData = nil
+
+	// chain delete empty nodes, from the leaf up
+	for i := range labels {
+		childrenNode := visitPath[len(visitPath)-1-i]
+		parentNode := visitPath[len(visitPath)-2-i]
+
+		if len(childrenNode.children) > 0 || childrenNode.domainData != nil {
+			break
+		}
+		delete(parentNode.children, labels[i])
+	}
+}
@@ -4,6 +4,12 @@ package nexns
 type DomainData struct {
 	Domain Domain
 	Zones  []Zone
+
+	// 发布该域名的 Controller 名称，由插件填写
+	Source string `json:"source,omitempty"`
+
+	// 应用本地覆盖之前的数据，未被覆盖时为空
+	original *DomainData
 }
 
 // Domain 包含了域名、SOA、DNSSEC信息
@@ -17,6 +23,10 @@ type Domain struct {
 	Retry   int    `json:"retry"`
 	Expire  int    `json:"expire"`
 	TTL     int    `json:"ttl"`
+
+	// 没有视图匹配客户端时的处理方式，为空则使用 Corefile 配置
+	NoMatch     string `json:"no_match"`
+	DefaultView string `json:"default_view"`
 }
 
 // Zone 包含了区域（zone）的规则信息
@@ -33,6 +43,22 @@ type RRSet struct {
 	Name    string   `json:"name"`
 	Type    string   `json:"type"`
 	Records []Record `json:"records"`
+
+	// 记录排序方式与单次应答最多返回的记录数，为空则使用 Corefile 配置
+	Order      string `json:"order"`
+	MaxAnswers int    `json:"max_answers"`
+
+	// A/AAAA 记录的健康检查，为空则使用 Corefile 配置
+	HealthCheck *HealthCheck `json:"health_check"`
+
+	// 主备切换参数，为空则使用 Corefile 配置
+	Failover *Failover `json:"failover"`
+}
+
+// Failover 包含了 RRset 主备记录池切换的参数
+type Failover struct {
+	TTL           int `json:"ttl"`            // 切换到备用池期间应答使用的 TTL 上限
+	FailbackDelay int `json:"failback_delay"` // 高优先级池需持续可用多少秒后才切回
 }
 
 // Record 包含了DNS资源记录的信息
@@ -40,4 +66,13 @@ type Record struct {
 	ID   int    `json:"id"`
 	TTL  int    `json:"ttl"`
 	Data string `json:"val"`
+
+	// weighted 排序时的权重，缺省为 1
+	Weight int `json:"weight"`
+
+	// 所属的记录池，0 为主池，数字越大优先级越低
+	Pool int `json:"pool"`
+
+	// 手动标记为不可用
+	Down bool `json:"down"`
 }
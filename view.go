@@ -0,0 +1,135 @@
+package nexns
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// 没有视图（zone）匹配客户端时的处理方式
+const (
+	NoMatchNXDomain    = "nxdomain"
+	NoMatchRefused     = "refused"
+	NoMatchFallthrough = "fallthrough"
+	NoMatchView        = "view"
+)
+
+// NoMatchLogInterval 是同一域名视图不匹配日志的最短间隔，期间的其他事件只计数
+const NoMatchLogInterval = time.Minute
+
+// NoMatchPolicy decides what to answer when none of a domain's views match the client
+type NoMatchPolicy struct {
+	Action string
+	View   string
+}
+
+// parseNoMatchPolicy parses "ACTION [VIEW]" from Corefile or controller data
+func parseNoMatchPolicy(action string, view string) (NoMatchPolicy, error) {
+	switch action {
+	case NoMatchNXDomain, NoMatchRefused, NoMatchFallthrough:
+		if view != "" {
+			return NoMatchPolicy{}, fmt.Errorf("no_match %s takes no view name", action)
+		}
+	case NoMatchView:
+		if view == "" {
+			return NoMatchPolicy{}, fmt.Errorf("no_match view requires a view name")
+		}
+	default:
+		return NoMatchPolicy{}, fmt.Errorf("unknown no_match action: %s", action)
+	}
+	return NoMatchPolicy{Action: action, View: view}, nil
+}
+
+// noMatchPolicy returns the domain's own policy if the controller set one, else the Corefile's
+func (p *NexnsPlugin) noMatchPolicy(domain *Domain) NoMatchPolicy {
+	if domain.NoMatch != "" {
+		policy, err := parseNoMatchPolicy(domain.NoMatch, domain.DefaultView)
+		if err == nil {
+			return policy
+		}
+	}
+	if p.NoMatch.Action == "" {
+		return NoMatchPolicy{Action: NoMatchNXDomain}
+	}
+	return p.NoMatch
+}
+
+// matchRules returns the views whose rules contain sourceIP, in controller order
+func matchRules(domainData *DomainData, sourceIP net.IP) []*Zone {
+	zones := make([]*Zone, 0)
+
+	for i := range domainData.Zones {
+		zone := &domainData.Zones[i]
+
+		for _, rule := range zone.Rules {
+			_, ipNet, err := net.ParseCIDR(rule)
+			if err != nil {
+				continue
+			}
+
+			if ipNet.Contains(sourceIP) {
+				zones = append(zones, zone)
+				break
+			}
+		}
+	}
+
+	return zones
+}
+
+// matchZones is matchRules, falling back to the default view of the no-match policy
+func (p *NexnsPlugin) matchZones(domainData *DomainData, sourceIP net.IP) []*Zone {
+	zones := matchRules(domainData, sourceIP)
+	if len(zones) > 0 {
+		return zones
+	}
+
+	policy := p.noMatchPolicy(&domainData.Domain)
+	if policy.Action != NoMatchView {
+		return zones
+	}
+	for i := range domainData.Zones {
+		if domainData.Zones[i].Name == policy.View {
+			return append(zones, &domainData.Zones[i])
+		}
+	}
+
+	return zones
+}
+
+// noMatchLog rate limits the log of no-match events per domain
+type noMatchLog struct {
+	lock       sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+// log logs a no-match event unless one of the same domain was logged within NoMatchLogInterval,
+// it returns whether the event was logged
+func (l *noMatchLog) log(domain string, sourceIP net.IP, policy NoMatchPolicy, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+		l.suppressed = make(map[string]int)
+	}
+	if last, exists := l.last[domain]; exists && now.Sub(last) < NoMatchLogInterval {
+		l.suppressed[domain]++
+		return false
+	}
+
+	action := policy.Action
+	if policy.Action == NoMatchView {
+		action += " " + policy.View
+	}
+	if suppressed := l.suppressed[domain]; suppressed > 0 {
+		log.Infof("No view of %s matches client %s, action: %s (%d more since last logged)", domain, sourceIP, action, suppressed)
+	} else {
+		log.Infof("No view of %s matches client %s, action: %s", domain, sourceIP, action)
+	}
+	l.last[domain] = now
+	delete(l.suppressed, domain)
+	return true
+}
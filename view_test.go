@@ -0,0 +1,33 @@
+package nexns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNoMatchLogRateLimit(t *testing.T) {
+	var l noMatchLog
+	client := net.ParseIP("8.8.8.8")
+	policy := NoMatchPolicy{Action: NoMatchRefused}
+	now := time.Now()
+
+	if !l.log("example.com", client, policy, now) {
+		t.Fatalf("Expected first event to be logged")
+	}
+	if l.log("example.com", client, policy, now.Add(time.Second)) {
+		t.Fatalf("Expected event within the interval to be suppressed")
+	}
+	if !l.log("test.com", client, policy, now.Add(time.Second)) {
+		t.Fatalf("Expected event of another domain to be logged")
+	}
+	if l.suppressed["example.com"] != 1 {
+		t.Fatalf("Expected suppressed event to be counted, got %d", l.suppressed["example.com"])
+	}
+	if !l.log("example.com", client, policy, now.Add(NoMatchLogInterval)) {
+		t.Fatalf("Expected event after the interval to be logged")
+	}
+	if l.suppressed["example.com"] != 0 {
+		t.Fatalf("Expected suppressed count to be reset once logged")
+	}
+}
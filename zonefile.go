@@ -0,0 +1,283 @@
+package nexns
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneFileDefaultView 是区域文件中第一个 $VIEW 之前的记录所属的视图，匹配所有客户端，排在其他视图之后
+const ZoneFileDefaultView = "default"
+
+// 匹配所有客户端的规则
+var allClients = []string{"0.0.0.0/0", "::/0"}
+
+// viewDirective matches a "; $VIEW NAME [CIDR...]" comment, which starts the records of a view in a zone file
+var viewDirective = regexp.MustCompile(`^\s*;\s*\$VIEW\s+(\S+)(.*)$`)
+
+// zoneFileView 是在 Corefile 中以单独文件声明的视图
+type zoneFileView struct {
+	name  string
+	path  string
+	rules []string
+}
+
+// zoneFileSource serves one zone from RFC 1035 zone files, split into views by $VIEW comments or by
+// a file per view. Files are polled for changes.
+type zoneFileSource struct {
+	origin   string // without trailing dot
+	path     string // may be empty if all views have their own files
+	views    []zoneFileView
+	interval time.Duration
+}
+
+func newZoneFileSource(origin string, path string) *zoneFileSource {
+	return &zoneFileSource{origin: strings.ToLower(strings.TrimSuffix(origin, ".")), path: path, interval: DefaultFileInterval}
+}
+
+func (s *zoneFileSource) String() string {
+	return s.origin
+}
+
+// zoneSection is a part of a zone file with the records of one view
+type zoneSection struct {
+	view  string
+	rules []string
+	text  string
+}
+
+// splitViews splits zone file content at $VIEW comments. $ORIGIN and $TTL carry over into later sections,
+// but the first record of a section must name its owner.
+func splitViews(content string, origin string) ([]zoneSection, error) {
+	sections := []zoneSection{{view: ZoneFileDefaultView, rules: allClients}}
+	current := &sections[0]
+	lines := make([]string, 0)
+	currentOrigin := origin + "."
+	ttl := ""
+
+	for _, line := range strings.Split(content, "\n") {
+		if match := viewDirective.FindStringSubmatch(line); match != nil {
+			current.text = strings.Join(lines, "\n")
+			rules := strings.Fields(strings.SplitN(match[2], ";", 2)[0])
+			if len(rules) == 0 {
+				return nil, fmt.Errorf("view %s has no rules", match[1])
+			}
+			sections = append(sections, zoneSection{view: match[1], rules: rules})
+			current = &sections[len(sections)-1]
+
+			lines = []string{"$ORIGIN " + currentOrigin}
+			if ttl != "" {
+				lines = append(lines, ttl)
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.EqualFold(fields[0], "$ORIGIN") {
+			if dns.IsFqdn(fields[1]) {
+				currentOrigin = fields[1]
+			} else {
+				currentOrigin = fields[1] + "." + currentOrigin
+			}
+		}
+		if len(fields) >= 2 && strings.EqualFold(fields[0], "$TTL") {
+			ttl = "$TTL " + fields[1]
+		}
+		lines = append(lines, line)
+	}
+	current.text = strings.Join(lines, "\n")
+
+	return sections, nil
+}
+
+// parseZone parses the records of a zone file section
+func parseZone(text string, origin string, file string) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0)
+	zp := dns.NewZoneParser(strings.NewReader(text), origin+".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+// localID derives a stable id for data from local files. Ids are negative, so they never collide with
+// ids assigned by a controller.
+func localID(parts ...string) int {
+	h := fnv.New32a()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return -int(h.Sum32()&0x7fffffff) - 1
+}
+
+// recordData returns the data of a record in the format of the controller
+func recordData(rr dns.RR) string {
+	if txt, ok := rr.(*dns.TXT); ok {
+		return strings.Join(txt.Txt, "")
+	}
+	return strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+}
+
+// zoneView holds the parsed records of a view
+type zoneView struct {
+	name  string
+	rules []string
+	rrs   []dns.RR
+}
+
+func (s *zoneFileSource) LoadAll() ([]*DomainData, error) {
+	views := make([]*zoneView, 0)
+	byName := make(map[string]*zoneView)
+	addView := func(name string, rules []string, rrs []dns.RR) {
+		if view, exists := byName[name]; exists {
+			view.rrs = append(view.rrs, rrs...)
+			return
+		}
+		view := &zoneView{name: name, rules: rules, rrs: rrs}
+		byName[name] = view
+		views = append(views, view)
+	}
+
+	// views with their own files first, in Corefile order
+	for _, view := range s.views {
+		content, err := os.ReadFile(view.path)
+		if err != nil {
+			return nil, err
+		}
+		rrs, err := parseZone(string(content), s.origin, view.path)
+		if err != nil {
+			return nil, err
+		}
+		addView(view.name, view.rules, rrs)
+	}
+
+	if s.path != "" {
+		content, err := os.ReadFile(s.path)
+		if err != nil {
+			return nil, err
+		}
+		sections, err := splitViews(string(content), s.origin)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.path, err)
+		}
+
+		// the default view matches every client, so it goes last
+		ordered := make([]zoneSection, 0, len(sections))
+		ordered = append(ordered, sections[1:]...)
+		ordered = append(ordered, sections[0])
+		for _, section := range ordered {
+			rrs, err := parseZone(section.text, s.origin, s.path)
+			if err != nil {
+				return nil, fmt.Errorf("view %s: %v", section.view, err)
+			}
+			if section.view == ZoneFileDefaultView && len(sections) > 1 && len(rrs) == 0 {
+				continue
+			}
+			addView(section.view, section.rules, rrs)
+		}
+	}
+
+	domainData, err := s.buildDomainData(views)
+	if err != nil {
+		return nil, err
+	}
+	return []*DomainData{domainData}, nil
+}
+
+// buildDomainData maps the SOA record into the domain and groups the other records into RRsets per view
+func (s *zoneFileSource) buildDomainData(views []*zoneView) (*DomainData, error) {
+	apex := s.origin + "."
+	domainData := &DomainData{
+		Domain: Domain{ID: localID(s.origin), Name: s.origin},
+		Zones:  make([]Zone, 0, len(views)),
+	}
+	hasSOA := false
+
+	for _, view := range views {
+		zone := Zone{ID: localID(s.origin, view.name), Name: view.name, Rules: view.rules, RRsets: make([]RRSet, 0)}
+		rrsets := make(map[string]int)
+
+		for _, rr := range view.rrs {
+			header := rr.Header()
+			owner := strings.ToLower(header.Name)
+			if owner != apex && !strings.HasSuffix(owner, "."+apex) {
+				return nil, fmt.Errorf("record %s is outside of zone %s", header.Name, s.origin)
+			}
+
+			if soa, ok := rr.(*dns.SOA); ok {
+				if owner != apex {
+					return nil, fmt.Errorf("SOA record of %s is not at the zone apex", header.Name)
+				}
+				if !hasSOA {
+					domainData.Domain.Mname = soa.Ns
+					domainData.Domain.Rname = soa.Mbox
+					domainData.Domain.Serial = strconv.FormatUint(uint64(soa.Serial), 10)
+					domainData.Domain.Refresh = int(soa.Refresh)
+					domainData.Domain.Retry = int(soa.Retry)
+					domainData.Domain.Expire = int(soa.Expire)
+					domainData.Domain.TTL = int(soa.Minttl)
+					hasSOA = true
+				}
+				continue
+			}
+
+			name := strings.TrimSuffix(strings.TrimSuffix(owner, apex), ".")
+			rtype := dns.TypeToString[header.Rrtype]
+			key := name + " " + rtype
+			index, exists := rrsets[key]
+			if !exists {
+				index = len(zone.RRsets)
+				rrsets[key] = index
+				zone.RRsets = append(zone.RRsets, RRSet{ID: localID(s.origin, view.name, key), Name: name, Type: rtype, Records: make([]Record, 0)})
+			}
+			rrset := &zone.RRsets[index]
+			rrset.Records = append(rrset.Records, Record{ID: len(rrset.Records) + 1, TTL: int(header.Ttl), Data: recordData(rr)})
+		}
+
+		domainData.Zones = append(domainData.Zones, zone)
+	}
+
+	if !hasSOA {
+		return nil, fmt.Errorf("zone %s has no SOA record", s.origin)
+	}
+	return domainData, nil
+}
+
+func (s *zoneFileSource) LoadDomain(id int) (*DomainData, error) {
+	domainDataList, err := s.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	if domainDataList[0].Domain.ID != id {
+		return nil, fmt.Errorf("domain id %d not found in zone %s", id, s.origin)
+	}
+	return domainDataList[0], nil
+}
+
+// files returns all zone files of the zone
+func (s *zoneFileSource) files() []string {
+	files := make([]string, 0, len(s.views)+1)
+	for _, view := range s.views {
+		files = append(files, view.path)
+	}
+	if s.path != "" {
+		files = append(files, s.path)
+	}
+	return files
+}
+
+func (s *zoneFileSource) Watch(stop <-chan struct{}, changed func(id int) error) {
+	watchFiles(stop, s.interval, "zone "+s.origin, func() string {
+		return filesState(s.files())
+	}, changed)
+}
@@ -0,0 +1,94 @@
+package nexns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testingZoneFile = `$ORIGIN example.com.
+$TTL 300
+@       IN SOA ns1 hostmaster 2024010101 3600 600 86400 60
+        IN NS  ns1
+ns1     IN A   192.0.2.53
+www     IN A   192.0.2.1
+        IN A   192.0.2.2
+txt     IN TXT "hello " "world"
+
+; $VIEW internal 10.0.0.0/8 192.168.0.0/16
+www     IN A   10.0.0.1
+intra   60 IN CNAME www
+`
+
+func TestZoneFileSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "example.com.zone")
+	err := os.WriteFile(path, []byte(testingZoneFile), 0644)
+	if err != nil {
+		t.Fatalf("Error writing zone file: %s", err)
+	}
+	lab := filepath.Join(dir, "lab.zone")
+	err = os.WriteFile(lab, []byte("$ORIGIN example.com.\nwww 30 IN A 172.16.0.1\n"), 0644)
+	if err != nil {
+		t.Fatalf("Error writing zone file: %s", err)
+	}
+
+	source := newZoneFileSource("example.com.", path)
+	source.views = []zoneFileView{{name: "lab", path: lab, rules: []string{"172.16.0.0/12"}}}
+	domainDataList, err := source.LoadAll()
+	if err != nil {
+		t.Fatalf("Error loading zone file: %s", err)
+	}
+
+	domainData := domainDataList[0]
+	domain := domainData.Domain
+	if domain.Name != "example.com" || domain.Serial != "2024010101" || domain.Mname != "ns1.example.com." || domain.TTL != 60 || domain.ID >= 0 {
+		t.Fatalf("Unexpected domain from SOA: %+v", domain)
+	}
+	if len(domainData.Zones) != 3 || domainData.Zones[0].Name != "lab" || domainData.Zones[1].Name != "internal" || domainData.Zones[2].Name != ZoneFileDefaultView {
+		t.Fatalf("Expected views lab, internal and default, got %+v", domainData.Zones)
+	}
+
+	e := newSyncEngine("")
+	controller := newController(e)
+	controller.source = source
+	e.Controllers = []*Controller{controller}
+	controller.applyDump(domainDataList)
+	p := &NexnsPlugin{engine: e}
+
+	lookup := func(name string, qtype string, client string) *RRSet {
+		_, _, rrset := p.searchRRset(name, qtype, net.ParseIP(client))
+		return rrset
+	}
+	if rrset := lookup("www.example.com.", "A", "8.8.8.8"); rrset == nil || len(rrset.Records) != 2 || rrset.Records[1].Data != "192.0.2.2" || rrset.Records[0].TTL != 300 {
+		t.Fatalf("Expected records of default view, got %+v", rrset)
+	}
+	if rrset := lookup("www.example.com.", "A", "10.1.2.3"); rrset == nil || rrset.Records[0].Data != "10.0.0.1" {
+		t.Fatalf("Expected record of internal view, got %+v", rrset)
+	}
+	if rrset := lookup("www.example.com.", "A", "172.16.1.1"); rrset == nil || rrset.Records[0].Data != "172.16.0.1" {
+		t.Fatalf("Expected record of view file, got %+v", rrset)
+	}
+	if rrset := lookup("ns1.example.com.", "A", "10.1.2.3"); rrset == nil {
+		t.Fatalf("Expected default view records for internal clients too")
+	}
+	if rrset := lookup("example.com.", "NS", "8.8.8.8"); rrset == nil || rrset.Records[0].Data != "ns1.example.com." {
+		t.Fatalf("Expected NS record at apex, got %+v", rrset)
+	}
+	if rrset := lookup("txt.example.com.", "TXT", "8.8.8.8"); rrset == nil || rrset.Records[0].Data != "hello world" {
+		t.Fatalf("Expected TXT strings to be joined, got %+v", rrset)
+	}
+	if rrset := lookup("intra.example.com.", "CNAME", "10.1.2.3"); rrset == nil || rrset.Records[0].TTL != 60 || rrset.Records[0].Data != "www.example.com." {
+		t.Fatalf("Expected CNAME of internal view, got %+v", rrset)
+	}
+
+	// records outside of the zone are refused
+	err = os.WriteFile(lab, []byte("www.example.org. 30 IN A 172.16.0.1\n"), 0644)
+	if err != nil {
+		t.Fatalf("Error writing zone file: %s", err)
+	}
+	if _, err := source.LoadAll(); err == nil {
+		t.Fatalf("Expected out of zone record to be refused")
+	}
+}